@@ -5,6 +5,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 
 	"github.com/harperreed/icloud-album-go/pkg/icloudalbum"
@@ -12,11 +13,15 @@ import (
 
 func main() {
 	log.SetFlags(0)
+	icloudalbum.SetDefaultLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
 	if len(os.Args) != 2 {
-		fmt.Fprintln(os.Stderr, "usage: album-info <shared_album_token>")
+		fmt.Fprintln(os.Stderr, "usage: album-info <shared_album_token_or_url>")
 		os.Exit(2)
 	}
-	token := os.Args[1]
+	token, err := icloudalbum.ParseAlbumRef(os.Args[1])
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
 
 	resp, err := icloudalbum.GetICloudPhotos(token)
 	if err != nil {
@@ -3,38 +3,116 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"time"
 
 	"github.com/harperreed/icloud-album-go/pkg/icloudalbum"
 )
 
 func main() {
 	log.SetFlags(0)
-	if len(os.Args) != 3 {
-		fmt.Fprintln(os.Stderr, "usage: download-photos <shared_album_token> <download_dir>")
+	icloudalbum.SetDefaultLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	concurrency := flag.Int("concurrency", icloudalbum.DefaultDownloadConcurrency, "number of photos to download at once")
+	perHost := flag.Int("per-host", 0, "maximum concurrent downloads per asset host (0 = no extra limit)")
+	failFast := flag.Bool("fail-fast", false, "stop at the first failed download")
+	template := flag.String("template", "", `path template for saved files, e.g. "{year}/{month}/{date}_{caption|guid}{ext}"`)
+	profileName := flag.String("filenames", "portable", "filename rules: portable, posix, windows or macos")
+	xmp := flag.Bool("xmp", false, "write an XMP sidecar (<file>.xmp) next to each photo")
+	takeout := flag.Bool("takeout-json", false, "write a Google Takeout-style <file>.json sidecar next to each photo")
+	exif := flag.Bool("exif", false, "write caption, capture date and contributor into each JPEG's EXIF")
+	noManifest := flag.Bool("no-manifest", false, "re-download everything instead of skipping files recorded in the manifest")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: download-photos [flags] <shared_album_token_or_url> <download_dir>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
 		os.Exit(2)
 	}
-	token := os.Args[1]
-	outDir := os.Args[2]
+	token, err := icloudalbum.ParseAlbumRef(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	outDir := flag.Arg(1)
+	var tmpl *icloudalbum.PathTemplate
+	if *template != "" {
+		if tmpl, err = icloudalbum.ParsePathTemplate(*template); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+	}
 
-	resp, err := icloudalbum.GetICloudPhotos(token)
+	profile, err := icloudalbum.ParseFilenameProfile(*profileName)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	resp, err := icloudalbum.GetICloudPhotosContext(ctx, token)
 	if err != nil {
 		log.Fatalf("error: %v", err)
 	}
 
 	fmt.Printf("Album: %s (%d photos)\n", resp.Metadata.StreamName, len(resp.Photos))
 
-	for i := range resp.Photos {
-		p := &resp.Photos[i]
-		fmt.Printf("Downloading %d/%d: %s\n", i+1, len(resp.Photos), p.PhotoGUID)
-		fp, err := icloudalbum.DownloadPhoto(p, &i, outDir, nil)
-		if err != nil {
-			fmt.Printf("  failed: %v\n", err)
-			continue
-		}
-		fmt.Printf("  saved: %s\n", filepath.Base(fp))
+	total := len(resp.Photos)
+	var post []icloudalbum.PostProcessor
+	if *exif {
+		post = append(post, icloudalbum.EXIFWriter{})
+	}
+	if *xmp {
+		post = append(post, icloudalbum.XMPSidecar{})
+	}
+	if *takeout {
+		post = append(post, icloudalbum.TakeoutSidecar{})
+	}
+
+	client := icloudalbum.NewClient(icloudalbum.WithFilenameProfile(profile))
+	report, err := client.DownloadAlbum(ctx, resp, icloudalbum.DownloadOptions{
+		OutputDir:      outDir,
+		Concurrency:    *concurrency,
+		PerHostLimit:   *perHost,
+		FailFast:       *failFast,
+		PathTemplate:   tmpl,
+		UseManifest:    !*noManifest,
+		PostProcessors: post,
+		OnResult: func(r icloudalbum.PhotoResult) {
+			switch r.Outcome {
+			case icloudalbum.OutcomeDownloaded:
+				switch r.Manifest {
+				case icloudalbum.ManifestMissing, icloudalbum.ManifestCorrupt, icloudalbum.ManifestChanged:
+					fmt.Printf("%d/%d %s: saved %s (previous file %s)\n", r.Index+1, total, r.PhotoGUID, filepath.Base(r.Path), r.Manifest)
+				default:
+					fmt.Printf("%d/%d %s: saved %s\n", r.Index+1, total, r.PhotoGUID, filepath.Base(r.Path))
+				}
+			case icloudalbum.OutcomeFailed:
+				fmt.Printf("%d/%d %s: failed: %v\n", r.Index+1, total, r.PhotoGUID, r.Err)
+			}
+			if r.DateErr != nil {
+				fmt.Printf("%d/%d %s: warning: %v\n", r.Index+1, total, r.PhotoGUID, r.DateErr)
+			}
+			if r.PostErr != nil {
+				fmt.Printf("%d/%d %s: warning: %v\n", r.Index+1, total, r.PhotoGUID, r.PostErr)
+			}
+		},
+	})
+
+	fmt.Printf("Downloaded %d, unchanged %d, failed %d, canceled %d (%d bytes in %s)\n",
+		report.Downloaded, report.Unchanged, report.Failed, report.Canceled, report.Bytes, report.Duration.Round(time.Millisecond))
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	if report.Failed > 0 {
+		os.Exit(1)
 	}
 }
@@ -1,3 +1,5 @@
 module github.com/harperreed/icloud-album-go
 
 go 1.22
+
+require golang.org/x/text v0.22.0
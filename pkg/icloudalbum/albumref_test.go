@@ -0,0 +1,52 @@
+// ABOUTME: Test suite for album reference parsing
+// ABOUTME: Covers bare tokens and every known iCloud share URL shape
+package icloudalbum
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseAlbumRef(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+		wantErr  error
+	}{
+		{"bare token", "B0aGWZuqDGKjsR", "B0aGWZuqDGKjsR", nil},
+		{"bare token with whitespace", "  B0aGWZuqDGKjsR\n", "B0aGWZuqDGKjsR", nil},
+		{"share URL", "https://www.icloud.com/sharedalbum/#B0aGWZuqDGKjsR", "B0aGWZuqDGKjsR", nil},
+		{"share URL without scheme", "www.icloud.com/sharedalbum/#B0aGWZuqDGKjsR", "B0aGWZuqDGKjsR", nil},
+		{"locale path", "https://www.icloud.com/sharedalbum/en-us/#B0aGWZuqDGKjsR", "B0aGWZuqDGKjsR", nil},
+		{"query string", "https://www.icloud.com/sharedalbum/?lang=en&x=1#B0aGWZuqDGKjsR", "B0aGWZuqDGKjsR", nil},
+		{"photo suffix", "https://www.icloud.com/sharedalbum/#B0aGWZuqDGKjsR;7B2F6C1E-0000-4A5B", "B0aGWZuqDGKjsR", nil},
+		{"china host", "https://www.icloud.com.cn/sharedalbum/#B0aGWZuqDGKjsR", "B0aGWZuqDGKjsR", nil},
+		{"quoted", `"https://www.icloud.com/sharedalbum/#B0aGWZuqDGKjsR"`, "B0aGWZuqDGKjsR", nil},
+		{"sharedstreams URL", "https://p23-sharedstreams.icloud.com/B0aGWZuqDGKjsR/sharedstreams/webstream", "B0aGWZuqDGKjsR", nil},
+		{"empty", "   ", "", ErrEmptyToken},
+		{"invalid char in token", "B0aGW-ZuqDGKjsR", "", ErrInvalidBase62},
+		{"invalid char in fragment", "https://www.icloud.com/sharedalbum/#B0aG%20WZ", "", ErrInvalidBase62},
+		{"missing fragment", "https://www.icloud.com/sharedalbum/", "", ErrInvalidAlbumRef},
+		{"foreign host", "https://example.com/sharedalbum/#B0aGWZuqDGKjsR", "", ErrInvalidAlbumRef},
+		{"lookalike host", "https://icloud.com.evil.example/sharedalbum/#B0aGWZuqDGKjsR", "", ErrInvalidAlbumRef},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseAlbumRef(tt.input)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseAlbumRef(%q) error = %v, want %v", tt.input, err, tt.wantErr)
+			}
+			if got != tt.expected {
+				t.Errorf("ParseAlbumRef(%q) = %q, want %q", tt.input, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGetBaseURL_RejectsInvalidCharAnywhere(t *testing.T) {
+	if _, err := GetBaseURL("B0aGWZ/../x"); err != ErrInvalidBase62 {
+		t.Errorf("GetBaseURL() error = %v, want ErrInvalidBase62", err)
+	}
+}
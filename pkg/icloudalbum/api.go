@@ -1,57 +1,118 @@
-// ABOUTME: API client for iCloud shared streams with retry logic and exponential backoff
-// ABOUTME: Fetches album metadata, photos, and asset URLs with configurable retry strategies
+// ABOUTME: API client for iCloud shared streams webstream and webasseturls endpoints
+// ABOUTME: Fetches album metadata, photos, and asset URLs through the shared retry executor
 package icloudalbum
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
-	"math/rand/v2"
 	"net/http"
-	"time"
+	"strings"
+	"sync"
 )
 
-// getAPIResponse performs POST {base}/webstream and returns parsed Photos + Metadata.
-func getAPIResponse(client *http.Client, baseURL string) ([]Image, Metadata, error) {
+// webstreamPayload builds the webstream request body. An empty ctag is sent as
+// null, which asks for the full album; a previous ctag asks for changes since then.
+func webstreamPayload(ctag string) []byte {
 	type payload struct {
-		StreamCTag *string `json:"streamCtag"` // null
+		StreamCTag *string `json:"streamCtag"`
 	}
-	body, _ := json.Marshal(payload{StreamCTag: nil})
-
-	req, err := http.NewRequest("POST", baseURL+"webstream", bytes.NewReader(body))
-	if err != nil {
-		return nil, Metadata{}, err
+	p := payload{}
+	if ctag != "" {
+		p.StreamCTag = &ctag
 	}
-	req.Header.Set("Content-Type", "application/json")
+	body, _ := json.Marshal(p)
+	return body
+}
+
+// webstreamResult is the parsed outcome of a webstream fetch.
+type webstreamResult struct {
+	baseURL   string // base URL that actually served the album
+	photos    []Image
+	md        Metadata
+	unchanged bool
+	warnings  []string       // lenient-parse problems
+	counts    *CountMismatch // nil when the counts agree
+	chain     []string       // redirect hosts visited, if any
+}
 
-	resp, err := client.Do(req)
+// getAPIResponse performs POST {base}/webstream and returns parsed Photos + Metadata.
+// Redirects are followed and the final target cached, so the redirect probe and
+// the metadata fetch share one request. When ctag is non-empty and the album has not
+// changed since, unchanged is set and no photos are returned.
+func (c *Client) getAPIResponse(ctx context.Context, token, baseURL, ctag string) (*webstreamResult, error) {
+	resp, baseURL, chain, err := c.resolveWebstream(ctx, token, baseURL, ctag)
 	if err != nil {
-		return nil, Metadata{}, err
+		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == 330 {
+		return nil, errors.New("webstream redirect (status 330) without X-Apple-MMe-Host")
+	}
+	if len(chain) > 0 {
+		c.redirects.put(token, baseURL)
+	}
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, Metadata{}, fmt.Errorf("webstream request failed (status %d)", resp.StatusCode)
+	res := &webstreamResult{baseURL: baseURL, chain: chain}
+	if resp.StatusCode == http.StatusNotModified {
+		res.md, res.unchanged = Metadata{StreamCTag: ctag}, true
+		return res, nil
 	}
 
 	var raw json.RawMessage
 	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
-		return nil, Metadata{}, err
+		return nil, err
 	}
 
 	// Lenient parse into ApiResponse
 	var api ApiResponse
 	if err := json.Unmarshal(raw, &api); err != nil {
-		log.Printf("warn: error deserializing API response: %v", err)
+		c.log(ctx).Warn("error deserializing API response", "endpoint", EndpointWebstream, "error", err)
+		res.warnings = append(res.warnings, fmt.Sprintf("error deserializing API response: %v", err))
+	}
+	res.warnings = append(res.warnings, lenientWarnings(raw)...)
+
+	// Same ctag back with nothing in it means "no changes since ctag".
+	if ctag != "" && derefOr(api.StreamCTag, ctag) == ctag && len(api.Photos) == 0 {
+		res.md, res.unchanged = buildMetadata(api, ctag), true
+		return res, nil
 	}
 
 	// streamName is required for a valid album (mirror Rust's Required severity)
 	if api.StreamName == nil || *api.StreamName == "" {
-		return nil, Metadata{}, errors.New("missing required field: streamName")
+		return nil, ErrMissingStreamName
 	}
 
+	for i, p := range api.Photos {
+		if p.PhotoGUID == "" {
+			res.warnings = append(res.warnings, fmt.Sprintf("photo %d has no photoGuid", i))
+		}
+	}
+	res.counts = checkCounts(api)
+	res.photos, res.md = api.Photos, buildMetadata(api, "")
+	return res, nil
+}
+
+// checkCounts compares itemsReturned, photoGuids and photos when present.
+func checkCounts(api ApiResponse) *CountMismatch {
+	cm := CountMismatch{ItemsReturned: -1, PhotoGuids: -1, Photos: len(api.Photos)}
+	if api.ItemsReturned != nil {
+		cm.ItemsReturned = int(*api.ItemsReturned)
+	}
+	if api.PhotoGuids != nil {
+		cm.PhotoGuids = len(api.PhotoGuids)
+	}
+	if (cm.ItemsReturned >= 0 && cm.ItemsReturned != cm.Photos) ||
+		(cm.PhotoGuids >= 0 && cm.PhotoGuids != cm.Photos) {
+		return &cm
+	}
+	return nil
+}
+
+// buildMetadata converts the lenient response into Metadata, using ctag when the
+// response carries none.
+func buildMetadata(api ApiResponse, ctag string) Metadata {
 	// Build metadata (fallbacks mirror the Rust behavior)
 	items := uint32(0)
 	if api.ItemsReturned != nil {
@@ -62,16 +123,14 @@ func getAPIResponse(client *http.Client, baseURL string) ([]Image, Metadata, err
 		locs = *api.Locations
 	}
 
-	md := Metadata{
-		StreamName:    *api.StreamName,
+	return Metadata{
+		StreamName:    derefOr(api.StreamName, ""),
 		UserFirstName: derefOr(api.UserFirstName, ""),
 		UserLastName:  derefOr(api.UserLastName, ""),
-		StreamCTag:    derefOr(api.StreamCTag, ""),
+		StreamCTag:    derefOr(api.StreamCTag, ctag),
 		ItemsReturned: items,
 		Locations:     locs,
 	}
-
-	return api.Photos, md, nil
 }
 
 func derefOr[T ~string](p *T, def T) T {
@@ -81,162 +140,174 @@ func derefOr[T ~string](p *T, def T) T {
 	return *p
 }
 
-// ------------------------------ Asset URLs + Retry ----------------------------
+// ------------------------------ Asset URLs ----------------------------------
 
-type BackoffStrategy int
-
-const (
-	BackoffConstant BackoffStrategy = iota
-	BackoffLinear
-	BackoffExponential
-	BackoffExponentialWithJitter
-)
-
-type RetryConfig struct {
-	MaxRetries                 int
-	BaseDelay                  time.Duration
-	Strategy                   BackoffStrategy
-	MaxDelay                   time.Duration
-	RetryableStatusCodes       []int // specific codes
-	PermanentFailureStatusCodes []int
+// GetAssetURLs calls {base}/webasseturls with photo GUIDs and returns a map id->fullURL.
+// Note: "id" keys are whatever Apple returns in `items` (photoGuid or checksum).
+func GetAssetURLs(client *http.Client, baseURL string, photoGUIDs []string, cfg *RetryConfig) (map[string]string, error) {
+	return GetAssetURLsContext(context.Background(), client, baseURL, photoGUIDs, cfg)
 }
 
-func DefaultRetryConfig() RetryConfig {
-	return RetryConfig{
-		MaxRetries: 3,
-		BaseDelay:  500 * time.Millisecond,
-		Strategy:   BackoffExponentialWithJitter,
-		MaxDelay:   30 * time.Second,
-		RetryableStatusCodes: []int{408, 429, 500, 502, 503, 504},
-		PermanentFailureStatusCodes: []int{400, 401, 403, 404},
+// GetAssetURLsContext is like GetAssetURLs but honors ctx for requests and backoff sleeps.
+func GetAssetURLsContext(ctx context.Context, client *http.Client, baseURL string, photoGUIDs []string, cfg *RetryConfig) (map[string]string, error) {
+	opts := []Option{WithHTTPClient(client)}
+	if cfg != nil {
+		opts = append(opts, WithRetryConfig(*cfg))
 	}
+	return NewClient(opts...).AssetURLs(ctx, baseURL, photoGUIDs)
 }
 
-func shouldRetryStatus(cfg RetryConfig, code int) bool {
-	for _, s := range cfg.PermanentFailureStatusCodes {
-		if code == s {
-			return false
-		}
-	}
-	for _, s := range cfg.RetryableStatusCodes {
-		if code == s {
-			return true
+// AssetURLs calls {base}/webasseturls with photo GUIDs and returns a map id->fullURL.
+// GUIDs are sent in batches with bounded concurrency (see WithAssetURLBatching);
+// each batch is retried according to the client's webasseturls retry policy.
+// The returned map holds every URL that could be fetched even when err is non-nil.
+func (c *Client) AssetURLs(ctx context.Context, baseURL string, photoGUIDs []string) (map[string]string, error) {
+	res, errs := c.assetURLs(ctx, baseURL, photoGUIDs)
+	// Special handling: 400 → known Apple quirk; continue without those URLs (parity with Rust)
+	kept := errs[:0]
+	for _, err := range errs {
+		var se *HTTPStatusError
+		if errors.As(err, &se) && se.StatusCode == http.StatusBadRequest {
+			c.log(ctx).Warn("webasseturls returned 400; continuing without those URLs",
+				"endpoint", EndpointAssetURLs, "status", se.StatusCode)
+			continue
 		}
+		kept = append(kept, err)
 	}
-	return code >= 500 && code <= 599
+	return res, errors.Join(kept...)
 }
 
-func nextDelay(cfg RetryConfig, attempt int) time.Duration {
-	switch cfg.Strategy {
-	case BackoffConstant:
-		return cfg.BaseDelay
-	case BackoffLinear:
-		d := time.Duration(attempt) * cfg.BaseDelay
-		if d > cfg.MaxDelay {
-			return cfg.MaxDelay
-		}
-		return d
-	case BackoffExponential:
-		d := cfg.BaseDelay * (1 << min(attempt, 30))
-		if d > cfg.MaxDelay {
-			return cfg.MaxDelay
-		}
-		return d
-	case BackoffExponentialWithJitter:
-		max := cfg.BaseDelay * (1 << min(attempt, 30))
-		if max > cfg.MaxDelay {
-			max = cfg.MaxDelay
-		}
-		if max <= 0 {
-			return 0
+// assetURLs is AssetURLs without the 400 quirk, so Fetch can report every
+// failure in Diagnostics.
+func (c *Client) assetURLs(ctx context.Context, baseURL string, photoGUIDs []string) (map[string]string, []error) {
+	res := map[string]string{}
+	if len(photoGUIDs) == 0 {
+		c.log(ctx).Debug("webasseturls called with empty photoGUIDs", "endpoint", EndpointAssetURLs)
+		return res, nil
+	}
+
+	var batches [][]string
+	for size := max(c.assetBatchSize, 1); len(photoGUIDs) > 0; {
+		n := min(size, len(photoGUIDs))
+		batches = append(batches, photoGUIDs[:n])
+		photoGUIDs = photoGUIDs[n:]
+	}
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs = make([][]error, len(batches)) // per batch, so the order is stable
+		sem  = make(chan struct{}, max(c.assetConcurrency, 1))
+	)
+dispatch:
+	for i, batch := range batches {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break dispatch
 		}
-		return time.Duration(rand.Int64N(max.Milliseconds()+1)) * time.Millisecond
-	default:
-		return cfg.BaseDelay
+		wg.Add(1)
+		go func(i int, batch []string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			m, e := c.assetURLBisect(ctx, baseURL, batch)
+			mu.Lock()
+			for k, v := range m {
+				res[k] = v
+			}
+			mu.Unlock()
+			errs[i] = e
+		}(i, batch)
 	}
-}
+	wg.Wait()
 
-func min(a, b int) int {
-	if a < b {
-		return a
+	var all []error
+	for _, e := range errs {
+		all = append(all, e...)
 	}
-	return b
+	if err := ctx.Err(); err != nil {
+		all = append(all, err)
+	}
+	return res, all
 }
 
-// GetAssetURLs calls {base}/webasseturls with photo GUIDs and returns a map id->fullURL.
-// Note: "id" keys are whatever Apple returns in `items` (photoGuid or checksum).
-func GetAssetURLs(client *http.Client, baseURL string, photoGUIDs []string, cfg *RetryConfig) (map[string]string, error) {
-	c := DefaultRetryConfig()
-	if cfg != nil {
-		c = *cfg
+// assetURLBisect fetches one batch. When Apple rejects it with 400, the batch is
+// split in half and each half retried, so one bad GUID cannot poison the rest.
+func (c *Client) assetURLBisect(ctx context.Context, baseURL string, batch []string) (map[string]string, []error) {
+	m, errs, err := c.assetURLBatch(ctx, baseURL, batch)
+	if err == nil {
+		return m, errs
 	}
-	if len(photoGUIDs) == 0 {
-		log.Printf("warn: get_asset_urls called with empty photoGUIDs")
-		return map[string]string{}, nil
+	var se *HTTPStatusError
+	if errors.As(err, &se) && se.StatusCode == http.StatusBadRequest && len(batch) > 1 && ctx.Err() == nil {
+		mid := len(batch) / 2
+		m, errs = c.assetURLBisect(ctx, baseURL, batch[:mid])
+		m2, errs2 := c.assetURLBisect(ctx, baseURL, batch[mid:])
+		for k, v := range m2 {
+			m[k] = v
+		}
+		return m, append(errs, errs2...)
 	}
+	c.log(ctx).Warn("webasseturls batch failed", "endpoint", EndpointAssetURLs, "guids", len(batch), "error", err)
+	return map[string]string{}, append(errs, &AssetURLError{GUIDs: batch, Err: err})
+}
 
+// assetURLBatch performs one webasseturls request. rejected lists items whose
+// URL failed the host policy; err is the request failure, if any.
+func (c *Client) assetURLBatch(ctx context.Context, baseURL string, photoGUIDs []string) (res map[string]string, rejected []error, err error) {
 	type payload struct {
 		PhotoGuids []string `json:"photoGuids"`
 	}
 	body, _ := json.Marshal(payload{PhotoGuids: photoGUIDs})
 
-	attempt := 0
-	for {
-		req, err := http.NewRequest("POST", baseURL+"webasseturls", bytes.NewReader(body))
-		if err != nil {
-			return nil, err
-		}
-		req.Header.Set("Content-Type", "application/json")
-
-		resp, err := client.Do(req)
-		if err != nil {
-			// treat as retryable network error
-			if attempt >= c.MaxRetries {
-				return nil, fmt.Errorf("webasseturls network error after retries: %w", err)
-			}
-			time.Sleep(nextDelay(c, attempt))
-			attempt++
-			continue
-		}
+	resp, err := c.do(ctx, apiCall{
+		endpoint: EndpointAssetURLs,
+		method:   "POST",
+		url:      baseURL + "webasseturls",
+		body:     body,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
 
-		// Special handling: 400 → known Apple quirk; continue with empty map (parity with Rust)
-		if resp.StatusCode == 400 {
-			resp.Body.Close()
-			log.Printf("warn: webasseturls returned 400; returning empty map for partial functionality")
-			return map[string]string{}, nil
-		}
+	// Parse successful response
+	var parsed struct {
+		Items map[string]struct {
+			URLLocation string `json:"url_location"`
+			URLPath     string `json:"url_path"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, nil, err
+	}
 
-		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-			resp.Body.Close()
-			if shouldRetryStatus(c, resp.StatusCode) && attempt < c.MaxRetries {
-				time.Sleep(nextDelay(c, attempt))
-				attempt++
-				continue
-			}
-			return nil, fmt.Errorf("webasseturls request failed (status %d)", resp.StatusCode)
+	res = make(map[string]string, len(parsed.Items))
+	for id, it := range parsed.Items {
+		if it.URLLocation == "" || it.URLPath == "" {
+			c.log(ctx).Warn("missing url_location or url_path", "endpoint", EndpointAssetURLs, "guid", id)
+			continue
 		}
-
-		// Parse successful response
-		var parsed struct {
-			Items map[string]struct {
-				URLLocation string `json:"url_location"`
-				URLPath     string `json:"url_path"`
-			} `json:"items"`
+		if err := c.checkHost(it.URLLocation, "asset url"); err != nil {
+			c.log(ctx).Warn("asset URL host rejected", "endpoint", EndpointAssetURLs, "guid", id, "error", err)
+			rejected = append(rejected, err)
+			continue
 		}
-		if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
-			resp.Body.Close()
-			return nil, err
+		if !strings.HasPrefix(it.URLPath, "/") {
+			c.log(ctx).Warn("asset URL path is not absolute", "endpoint", EndpointAssetURLs, "guid", id)
+			rejected = append(rejected, &HostNotAllowedError{Host: it.URLLocation, Source: "asset url", Reason: "url_path is not absolute"})
+			continue
 		}
-		resp.Body.Close()
+		res[id] = "https://" + it.URLLocation + it.URLPath
+	}
+	return res, rejected, nil
+}
 
-		res := make(map[string]string, len(parsed.Items))
-		for id, it := range parsed.Items {
-			if it.URLLocation == "" || it.URLPath == "" {
-				log.Printf("warn: missing url_location or url_path for id %s", id)
-				continue
-			}
-			res[id] = "https://" + it.URLLocation + it.URLPath
-		}
-		return res, nil
+// WithAssetURLBatching sets how many GUIDs go into each webasseturls request
+// (default 25) and how many requests run at once (default 4).
+func WithAssetURLBatching(batchSize, concurrency int) Option {
+	return func(c *Client) {
+		c.assetBatchSize = batchSize
+		c.assetConcurrency = concurrency
 	}
 }
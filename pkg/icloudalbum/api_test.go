@@ -0,0 +1,138 @@
+// ABOUTME: Test suite for the iCloud API client using httptest servers
+// ABOUTME: Validates context cancellation during requests and retry backoff
+package icloudalbum
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSleepContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	if err := sleepContext(ctx, time.Minute); !errors.Is(err, context.Canceled) {
+		t.Errorf("sleepContext() error = %v, want context.Canceled", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("sleepContext() should return immediately for a cancelled context")
+	}
+
+	if err := sleepContext(context.Background(), time.Millisecond); err != nil {
+		t.Errorf("sleepContext() error = %v, want nil", err)
+	}
+}
+
+func TestGetAssetURLsContext_CancelDuringBackoff(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	cfg := DefaultRetryConfig()
+	cfg.Strategy = BackoffConstant
+	cfg.BaseDelay = time.Minute
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := GetAssetURLsContext(ctx, srv.Client(), srv.URL+"/", []string{"guid1"}, &cfg)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetAssetURLsContext() error = %v, want context.DeadlineExceeded", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("backoff sleep should stop when the context is done")
+	}
+	if hits.Load() != 1 {
+		t.Errorf("server hits = %d, want 1", hits.Load())
+	}
+}
+
+// assetServer answers webasseturls for any GUIDs, rejecting batches containing "bad".
+func assetServer(t *testing.T, requests *atomic.Int32, inFlight, peak *atomic.Int32) *httptest.Server {
+	t.Helper()
+	return newFakeAlbumServer(t, fakeAlbum{
+		webasseturls: func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			if n := inFlight.Add(1); n > peak.Load() {
+				peak.Store(n)
+			}
+			defer inFlight.Add(-1)
+			time.Sleep(5 * time.Millisecond)
+
+			var body struct {
+				PhotoGuids []string `json:"photoGuids"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			items := map[string]any{}
+			for _, g := range body.PhotoGuids {
+				if g == "bad" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				items[g] = map[string]any{"url_location": "cvws.icloud-content.com", "url_path": "/" + g}
+			}
+			writeJSON(w, map[string]any{"items": items})
+		},
+	})
+}
+
+func TestClient_AssetURLsBatchesConcurrently(t *testing.T) {
+	var requests, inFlight, peak atomic.Int32
+	srv := assetServer(t, &requests, &inFlight, &peak)
+	c := NewClient(WithAssetURLBatching(10, 2))
+
+	guids := make([]string, 45)
+	for i := range guids {
+		guids[i] = fmt.Sprintf("g%02d", i)
+	}
+	urls, err := c.AssetURLs(context.Background(), srv.URL+"/t/sharedstreams/", guids)
+	if err != nil {
+		t.Fatalf("AssetURLs() error = %v", err)
+	}
+	if len(urls) != 45 {
+		t.Errorf("len(urls) = %d, want 45", len(urls))
+	}
+	if requests.Load() != 5 {
+		t.Errorf("requests = %d, want 5 batches", requests.Load())
+	}
+	if peak.Load() > 2 {
+		t.Errorf("peak concurrency = %d, want <= 2", peak.Load())
+	}
+}
+
+func TestClient_AssetURLsBisectsBadGUID(t *testing.T) {
+	var requests, inFlight, peak atomic.Int32
+	srv := assetServer(t, &requests, &inFlight, &peak)
+	c := NewClient(WithAssetURLBatching(8, 1))
+
+	guids := []string{"g0", "g1", "g2", "bad", "g4", "g5", "g6", "g7"}
+	urls, errs := c.assetURLs(context.Background(), srv.URL+"/t/sharedstreams/", guids)
+	if len(urls) != 7 {
+		t.Errorf("len(urls) = %d, want 7 (all but the bad GUID)", len(urls))
+	}
+	if len(errs) != 1 {
+		t.Fatalf("errs = %v, want exactly one", errs)
+	}
+	var ae *AssetURLError
+	if !errors.As(errs[0], &ae) || len(ae.GUIDs) != 1 || ae.GUIDs[0] != "bad" {
+		t.Errorf("error = %v, want AssetURLError for [bad]", errs[0])
+	}
+
+	// The public API keeps the historical 400 quirk: no error, partial map.
+	urls, err := c.AssetURLs(context.Background(), srv.URL+"/t/sharedstreams/", guids)
+	if err != nil || len(urls) != 7 {
+		t.Errorf("AssetURLs() = %d urls, %v; want 7 urls and nil", len(urls), err)
+	}
+}
@@ -1,5 +1,5 @@
 // ABOUTME: Generates iCloud shared streams base URLs using base62 partition calculation
-// ABOUTME: Maps album tokens to correct regional server endpoints (p01-p40)
+// ABOUTME: Maps album tokens of both generations ('A' and 'B' prefixed) to pXX server hosts
 package icloudalbum
 
 import (
@@ -9,8 +9,9 @@ import (
 )
 
 var (
-	ErrEmptyToken      = errors.New("empty token")
-	ErrInvalidBase62   = errors.New("invalid base62 character")
+	ErrEmptyToken    = errors.New("empty token")
+	ErrInvalidBase62 = errors.New("invalid base62 character")
+	ErrTokenTooShort = errors.New("token too short")
 )
 
 func charToBase62(r rune) (uint32, error) {
@@ -26,15 +27,43 @@ func charToBase62(r rune) (uint32, error) {
 	}
 }
 
+// base62Value decodes s as a big-endian base62 number.
+func base62Value(s string) (uint32, error) {
+	var v uint32
+	for _, r := range s {
+		d, err := charToBase62(r)
+		if err != nil {
+			return 0, err
+		}
+		v = v*62 + d
+	}
+	return v, nil
+}
+
+// calculatePartition returns the pXX server number encoded in token:
+//   - 'A' tokens (first generation) store it in the second character.
+//   - 'B' tokens (second generation) store it in the second and third characters.
+//   - Anything else falls back to 1 + (first character % 40), as the Rust crate did.
 func calculatePartition(token string) (uint32, error) {
 	if token == "" || strings.TrimSpace(token) == "" {
 		return 0, ErrEmptyToken
 	}
-	r := []rune(token)[0]
-	v, err := charToBase62(r)
-	if err != nil {
+	if _, err := checkToken(token); err != nil {
 		return 0, err
 	}
+	switch token[0] {
+	case 'A':
+		if len(token) < 2 {
+			return 0, ErrTokenTooShort
+		}
+		return base62Value(token[1:2])
+	case 'B':
+		if len(token) < 3 {
+			return 0, ErrTokenTooShort
+		}
+		return base62Value(token[1:3])
+	}
+	v, _ := charToBase62(rune(token[0]))
 	return 1 + (v % 40), nil
 }
 
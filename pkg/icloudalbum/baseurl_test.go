@@ -51,9 +51,29 @@ func TestCalculatePartition(t *testing.T) {
 			expected: 1, // (0 % 40) + 1 = 1
 		},
 		{
-			name:     "token starting with A",
-			token:    "Axyz789",
-			expected: 11, // (10 % 40) + 1 = 11
+			name:     "first-generation A token",
+			token:    "A5xyz789",
+			expected: 5, // base62("5")
+		},
+		{
+			name:     "second-generation B token",
+			token:    "B0aGWZuqDGKjsR",
+			expected: 36, // base62("0a") = 0*62 + 36
+		},
+		{
+			name:     "second-generation B token, two-digit prefix",
+			token:    "B1A2cdefghijkl",
+			expected: 72, // base62("1A") = 1*62 + 10
+		},
+		{
+			name:    "B token too short",
+			token:   "B0",
+			wantErr: true,
+		},
+		{
+			name:    "A token too short",
+			token:   "A",
+			wantErr: true,
 		},
 		{
 			name:     "token starting with a",
@@ -104,9 +124,24 @@ func TestGetBaseURL(t *testing.T) {
 			expected: "https://p01-sharedstreams.icloud.com/0abc123/sharedstreams/",
 		},
 		{
-			name:     "token starting with A",
-			token:    "Axyz789",
-			expected: "https://p11-sharedstreams.icloud.com/Axyz789/sharedstreams/",
+			name:     "first-generation A token",
+			token:    "AHxyz789",
+			expected: "https://p17-sharedstreams.icloud.com/AHxyz789/sharedstreams/",
+		},
+		{
+			name:     "second-generation B token",
+			token:    "B0aGWZuqDGKjsR",
+			expected: "https://p36-sharedstreams.icloud.com/B0aGWZuqDGKjsR/sharedstreams/",
+		},
+		{
+			name:     "second-generation B token, low partition",
+			token:    "B07xKpQ2mVn9Ls",
+			expected: "https://p07-sharedstreams.icloud.com/B07xKpQ2mVn9Ls/sharedstreams/",
+		},
+		{
+			name:     "second-generation B token, high partition",
+			token:    "B0z5qAGN1JIFd3y",
+			expected: "https://p61-sharedstreams.icloud.com/B0z5qAGN1JIFd3y/sharedstreams/",
 		},
 		{
 			name:     "token starting with a",
@@ -0,0 +1,165 @@
+// ABOUTME: Configurable client for iCloud shared albums built from functional options
+// ABOUTME: Bundles HTTP clients, retry policy, logger and derivative selection in one value
+package icloudalbum
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DerivativeSelector picks which derivative of a photo to download.
+// SelectBestDerivative is the default.
+type DerivativeSelector func(derivs map[string]Derivative) (key string, d Derivative, url string, ok bool)
+
+// Client fetches and downloads iCloud shared albums using a single configuration.
+// A Client is immutable after NewClient returns and is safe for concurrent use.
+type Client struct {
+	httpClient       *http.Client
+	downloadClient   *http.Client
+	retry            RetryConfig
+	endpointRetry    map[Endpoint]RetryConfig
+	logger           *slog.Logger
+	userAgent        string
+	baseURL          string
+	selectDerivative DerivativeSelector
+	redirects        *redirectCache
+	strict           DiagnosticKind
+	allowedHosts     []string
+	maxRedirects     int
+	assetBatchSize   int
+	assetConcurrency int
+	assetURLTTL      time.Duration
+	resumable        bool
+	profile          FilenameProfile
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for album metadata and asset URL requests.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		if hc != nil {
+			c.httpClient = hc
+		}
+	}
+}
+
+// WithDownloadHTTPClient sets the HTTP client used for photo downloads.
+func WithDownloadHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		if hc != nil {
+			c.downloadClient = hc
+		}
+	}
+}
+
+// WithRetryConfig sets the retry policy.
+func WithRetryConfig(cfg RetryConfig) Option {
+	return func(c *Client) { c.retry = cfg }
+}
+
+// WithLogger sets the structured logger for diagnostics. Records carry attributes
+// such as token_hash, endpoint, attempt, guid and status. A nil logger discards output.
+func WithLogger(l *slog.Logger) Option {
+	return func(c *Client) {
+		if l == nil {
+			l = slog.New(discardHandler{})
+		}
+		c.logger = l
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent with every request.
+func WithUserAgent(ua string) Option {
+	return func(c *Client) { c.userAgent = ua }
+}
+
+// WithBaseURL overrides the partition-derived base URL, mainly for testing.
+// The album token is appended as {base}{token}/sharedstreams/.
+func WithBaseURL(base string) Option {
+	return func(c *Client) {
+		if base != "" && !strings.HasSuffix(base, "/") {
+			base += "/"
+		}
+		c.baseURL = base
+	}
+}
+
+// WithDerivativeSelector sets the policy used to choose which derivative to download.
+func WithDerivativeSelector(fn DerivativeSelector) Option {
+	return func(c *Client) {
+		if fn != nil {
+			c.selectDerivative = fn
+		}
+	}
+}
+
+// WithRedirectCacheTTL sets how long a token's 330 redirect target is reused
+// before the partition is probed again. Zero disables the cache.
+func WithRedirectCacheTTL(ttl time.Duration) Option {
+	return func(c *Client) { c.redirects = newRedirectCache(ttl) }
+}
+
+// withRedirectCache makes the client share rc instead of owning a cache.
+func withRedirectCache(rc *redirectCache) Option {
+	return func(c *Client) { c.redirects = rc }
+}
+
+// NewClient returns a Client with defaults matching the package-level functions.
+func NewClient(opts ...Option) *Client {
+	c := &Client{
+		httpClient:       defaultClient,
+		downloadClient:   downloadClient,
+		retry:            DefaultRetryConfig(),
+		logger:           defaultLogger(),
+		selectDerivative: SelectBestDerivative,
+		redirects:        newRedirectCache(time.Hour),
+		allowedHosts:     DefaultAllowedHosts,
+		maxRedirects:     5,
+		assetBatchSize:   25,
+		assetConcurrency: 4,
+		assetURLTTL:      30 * time.Minute,
+		resumable:        true,
+		profile:          ProfilePortable,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// albumBaseURL returns the sharedstreams base URL for token, honoring WithBaseURL.
+func (c *Client) albumBaseURL(token string) (string, error) {
+	if c.baseURL == "" {
+		return GetBaseURL(token)
+	}
+	if _, err := calculatePartition(token); err != nil {
+		return "", err
+	}
+	return c.baseURL + token + "/sharedstreams/", nil
+}
+
+// newRequest builds a request carrying the client's headers. A non-nil body is sent as JSON.
+func (c *Client) newRequest(ctx context.Context, method, url string, body []byte) (*http.Request, error) {
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, rd)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	return req, nil
+}
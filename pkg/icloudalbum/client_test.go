@@ -0,0 +1,269 @@
+// ABOUTME: Test suite for the configurable Client and its functional options
+// ABOUTME: Runs full fetch and download flows against an httptest album server
+package icloudalbum
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeAlbum serves a minimal webstream/webasseturls pair for one album.
+type fakeAlbum struct {
+	webstream    http.HandlerFunc
+	webasseturls http.HandlerFunc
+	assets       http.HandlerFunc
+}
+
+func newFakeAlbumServer(t *testing.T, fa fakeAlbum) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/sharedstreams/webstream") && fa.webstream != nil:
+			fa.webstream(w, r)
+		case strings.HasSuffix(r.URL.Path, "/sharedstreams/webasseturls") && fa.webasseturls != nil:
+			fa.webasseturls(w, r)
+		case strings.HasPrefix(r.URL.Path, "/assets/") && fa.assets != nil:
+			fa.assets(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func TestNewClient_Defaults(t *testing.T) {
+	c := NewClient()
+	if c.httpClient != defaultClient {
+		t.Error("default HTTP client should be the package default")
+	}
+	if c.downloadClient != downloadClient {
+		t.Error("default download client should be the package default")
+	}
+	if c.retry.MaxRetries != DefaultRetryConfig().MaxRetries {
+		t.Errorf("retry.MaxRetries = %d, want %d", c.retry.MaxRetries, DefaultRetryConfig().MaxRetries)
+	}
+	if c.selectDerivative == nil || c.logger == nil {
+		t.Error("selector and logger should be set by default")
+	}
+}
+
+func TestClient_AlbumBaseURL(t *testing.T) {
+	c := NewClient(WithBaseURL("http://127.0.0.1:1234"))
+	got, err := c.albumBaseURL("B0aGWZuqDGKjsR")
+	if err != nil {
+		t.Fatalf("albumBaseURL() error = %v", err)
+	}
+	if want := "http://127.0.0.1:1234/B0aGWZuqDGKjsR/sharedstreams/"; got != want {
+		t.Errorf("albumBaseURL() = %q, want %q", got, want)
+	}
+	if _, err := c.albumBaseURL(""); err == nil {
+		t.Error("albumBaseURL(\"\") should fail")
+	}
+}
+
+func TestClient_FetchAndDownload(t *testing.T) {
+	srv := newFakeAlbumServer(t, fakeAlbum{
+		webstream: func(w http.ResponseWriter, r *http.Request) {
+			if got := r.Header.Get("User-Agent"); got != "test-agent/1.0" {
+				t.Errorf("User-Agent = %q, want test-agent/1.0", got)
+			}
+			writeJSON(w, map[string]any{
+				"streamName":    "Test Album",
+				"userFirstName": "Ada",
+				"userLastName":  "Lovelace",
+				"streamCtag":    "ctag-1",
+				"itemsReturned": "1",
+				"photos": []map[string]any{{
+					"photoGuid": "guid1",
+					"caption":   "Hello",
+					"derivatives": map[string]any{
+						"original": map[string]any{"checksum": "sum1", "width": "4", "height": "3"},
+					},
+				}},
+			})
+		},
+		webasseturls: func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, map[string]any{"items": map[string]any{
+				"sum1": map[string]any{"url_location": "cvws.icloud-content.com", "url_path": "/assets/sum1"},
+			}})
+		},
+		assets: func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x10})
+		},
+	})
+
+	// Asset URLs are always https on Apple hosts; route them back to the test server.
+	c := NewClient(
+		WithBaseURL(srv.URL),
+		WithHTTPClient(srv.Client()),
+		WithDownloadHTTPClient(routeTo(map[string]*httptest.Server{"cvws.icloud-content.com": srv})),
+		WithUserAgent("test-agent/1.0"),
+	)
+
+	resp, err := c.Fetch(context.Background(), "B0aGWZuqDGKjsR")
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if resp.Metadata.StreamName != "Test Album" || resp.Metadata.ItemsReturned != 1 {
+		t.Errorf("Metadata = %+v", resp.Metadata)
+	}
+	if len(resp.Photos) != 1 || resp.Photos[0].Derivatives["original"].URL == nil {
+		t.Fatalf("Photos = %+v, want one enriched photo", resp.Photos)
+	}
+
+	dir := t.TempDir()
+	fp, err := c.Download(context.Background(), &resp.Photos[0], nil, dir, nil)
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	if want := filepath.Join(dir, "guid1_Hello.jpg"); fp != want {
+		t.Errorf("Download() path = %q, want %q", fp, want)
+	}
+	if b, err := os.ReadFile(fp); err != nil || len(b) != 6 {
+		t.Errorf("downloaded file = %v bytes, err %v", len(b), err)
+	}
+}
+
+// routeTransport sends requests for Apple host names to plain-HTTP test servers,
+// so server-supplied hosts can pass the allowlist in tests.
+type routeTransport struct{ routes map[string]*httptest.Server }
+
+func routeTo(routes map[string]*httptest.Server) *http.Client {
+	return &http.Client{Transport: routeTransport{routes}}
+}
+
+func (rt routeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if srv, ok := rt.routes[req.URL.Hostname()]; ok {
+		req = req.Clone(req.Context())
+		req.URL.Scheme = "http"
+		req.URL.Host = strings.TrimPrefix(srv.URL, "http://")
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestClient_FetchSince(t *testing.T) {
+	var assetCalls atomic.Int32
+	srv := newFakeAlbumServer(t, fakeAlbum{
+		webstream: func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				StreamCTag *string `json:"streamCtag"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			switch {
+			case body.StreamCTag == nil:
+				t.Error("FetchSince should send the previous ctag")
+			case *body.StreamCTag == "ctag-2":
+				writeJSON(w, map[string]any{"streamCtag": "ctag-2", "photos": []any{}})
+			default:
+				writeJSON(w, map[string]any{
+					"streamName": "Test Album",
+					"streamCtag": "ctag-2",
+					"photos": []map[string]any{{
+						"photoGuid":   "new-guid",
+						"derivatives": map[string]any{"1": map[string]any{"checksum": "sum2"}},
+					}},
+				})
+			}
+		},
+		webasseturls: func(w http.ResponseWriter, r *http.Request) {
+			assetCalls.Add(1)
+			writeJSON(w, map[string]any{"items": map[string]any{}})
+		},
+	})
+	c := NewClient(WithBaseURL(srv.URL), WithHTTPClient(srv.Client()))
+
+	resp, err := c.FetchSince(context.Background(), "B0aGWZuqDGKjsR", "ctag-1")
+	if err != nil {
+		t.Fatalf("FetchSince(ctag-1) error = %v", err)
+	}
+	if resp.Unchanged || len(resp.Photos) != 1 || resp.Metadata.StreamCTag != "ctag-2" {
+		t.Errorf("FetchSince(ctag-1) = %+v, want one changed photo and ctag-2", resp)
+	}
+
+	resp, err = c.FetchSince(context.Background(), "B0aGWZuqDGKjsR", "ctag-2")
+	if err != nil {
+		t.Fatalf("FetchSince(ctag-2) error = %v", err)
+	}
+	if !resp.Unchanged || len(resp.Photos) != 0 || resp.Metadata.StreamCTag != "ctag-2" {
+		t.Errorf("FetchSince(ctag-2) = %+v, want unchanged", resp)
+	}
+	if assetCalls.Load() != 1 {
+		t.Errorf("webasseturls calls = %d, want 1 (unchanged fetch should skip it)", assetCalls.Load())
+	}
+}
+
+func TestClient_FetchReusesRedirectProbe(t *testing.T) {
+	var albumHits, partitionHits atomic.Int32
+	album := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/webstream"):
+			albumHits.Add(1)
+			writeJSON(w, map[string]any{"streamName": "Moved Album", "photos": []any{}})
+		default:
+			writeJSON(w, map[string]any{"items": map[string]any{}})
+		}
+	}))
+	defer album.Close()
+	partition := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		partitionHits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(330)
+		_ = json.NewEncoder(w).Encode(map[string]string{"X-Apple-MMe-Host": "p99-sharedstreams.icloud.com"})
+	}))
+	defer partition.Close()
+
+	c := NewClient(
+		WithBaseURL(partition.URL),
+		WithHTTPClient(routeTo(map[string]*httptest.Server{"p99-sharedstreams.icloud.com": album})),
+	)
+	for i := 0; i < 2; i++ {
+		resp, err := c.Fetch(context.Background(), "B0aGWZuqDGKjsR")
+		if err != nil {
+			t.Fatalf("Fetch() #%d error = %v", i+1, err)
+		}
+		if resp.Metadata.StreamName != "Moved Album" {
+			t.Errorf("StreamName = %q, want Moved Album", resp.Metadata.StreamName)
+		}
+	}
+	if partitionHits.Load() != 1 {
+		t.Errorf("partition hits = %d, want 1 (redirect target should be cached)", partitionHits.Load())
+	}
+	if albumHits.Load() != 2 {
+		t.Errorf("album webstream hits = %d, want 2 (one per fetch)", albumHits.Load())
+	}
+}
+
+func TestRedirectCache_TTL(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rc := newRedirectCache(time.Minute)
+	rc.now = func() time.Time { return now }
+
+	rc.put("tok", "https://p99-sharedstreams.icloud.com/tok/sharedstreams/")
+	if got, ok := rc.get("tok"); !ok || got == "" {
+		t.Fatal("get() should return a fresh entry")
+	}
+	now = now.Add(2 * time.Minute)
+	if _, ok := rc.get("tok"); ok {
+		t.Error("get() should drop expired entries")
+	}
+
+	disabled := newRedirectCache(0)
+	disabled.put("tok", "x")
+	if _, ok := disabled.get("tok"); ok {
+		t.Error("zero TTL should disable the cache")
+	}
+}
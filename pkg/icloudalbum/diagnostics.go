@@ -0,0 +1,122 @@
+// ABOUTME: Non-fatal problems collected while fetching an album
+// ABOUTME: Reports asset URL failures, missing URLs, parse warnings and count mismatches
+package icloudalbum
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Diagnostics lists problems that degraded a fetch without failing it.
+type Diagnostics struct {
+	// AssetURLErrors holds webasseturls failures, including Apple's 400 quirk.
+	AssetURLErrors []error
+	// MissingURLs lists GUIDs of photos with no derivative URL after enrichment.
+	MissingURLs []string
+	// ParseWarnings lists problems from the lenient webstream decode.
+	ParseWarnings []string
+	// CountMismatch is set when itemsReturned, photoGuids and photos disagree.
+	CountMismatch *CountMismatch
+	// RedirectChain lists the webstream hosts visited, first to last, when the
+	// album was redirected. It is informational and never fails a fetch.
+	RedirectChain []string
+}
+
+// CountMismatch records disagreeing item counts; -1 means the field was absent.
+type CountMismatch struct {
+	ItemsReturned int
+	PhotoGuids    int
+	Photos        int
+}
+
+// DiagnosticKind selects categories of Diagnostics, e.g. for WithStrictDiagnostics.
+type DiagnosticKind uint
+
+const (
+	DiagAssetURLErrors DiagnosticKind = 1 << iota
+	DiagMissingURLs
+	DiagParseWarnings
+	DiagCountMismatch
+
+	DiagAll = DiagAssetURLErrors | DiagMissingURLs | DiagParseWarnings | DiagCountMismatch
+)
+
+// WithStrictDiagnostics makes Fetch fail with a *DiagnosticsError when any of the
+// selected kinds of problem is found.
+func WithStrictDiagnostics(kinds DiagnosticKind) Option {
+	return func(c *Client) { c.strict = kinds }
+}
+
+// Empty reports whether no problems were recorded.
+func (d Diagnostics) Empty() bool {
+	return d.kinds() == 0
+}
+
+func (d Diagnostics) kinds() DiagnosticKind {
+	var k DiagnosticKind
+	if len(d.AssetURLErrors) > 0 {
+		k |= DiagAssetURLErrors
+	}
+	if len(d.MissingURLs) > 0 {
+		k |= DiagMissingURLs
+	}
+	if len(d.ParseWarnings) > 0 {
+		k |= DiagParseWarnings
+	}
+	if d.CountMismatch != nil {
+		k |= DiagCountMismatch
+	}
+	return k
+}
+
+// DiagnosticsError is returned by Fetch when strict diagnostics are enabled.
+type DiagnosticsError struct {
+	// Kinds is the subset of strict kinds that were found.
+	Kinds       DiagnosticKind
+	Diagnostics Diagnostics
+}
+
+func (e *DiagnosticsError) Error() string {
+	var parts []string
+	d := e.Diagnostics
+	if e.Kinds&DiagAssetURLErrors != 0 {
+		parts = append(parts, fmt.Sprintf("%d asset URL errors (first: %v)", len(d.AssetURLErrors), d.AssetURLErrors[0]))
+	}
+	if e.Kinds&DiagMissingURLs != 0 {
+		parts = append(parts, fmt.Sprintf("%d photos without URLs", len(d.MissingURLs)))
+	}
+	if e.Kinds&DiagParseWarnings != 0 {
+		parts = append(parts, fmt.Sprintf("%d parse warnings (first: %s)", len(d.ParseWarnings), d.ParseWarnings[0]))
+	}
+	if e.Kinds&DiagCountMismatch != 0 {
+		cm := d.CountMismatch
+		parts = append(parts, fmt.Sprintf("count mismatch (itemsReturned=%d photoGuids=%d photos=%d)", cm.ItemsReturned, cm.PhotoGuids, cm.Photos))
+	}
+	return "album fetch diagnostics: " + strings.Join(parts, "; ")
+}
+
+// Unwrap exposes the asset URL errors so errors.Is/As can see through.
+func (e *DiagnosticsError) Unwrap() []error {
+	if e.Kinds&DiagAssetURLErrors == 0 {
+		return nil
+	}
+	return e.Diagnostics.AssetURLErrors
+}
+
+// photosWithoutURLs returns GUIDs of photos where no derivative has a URL.
+func photosWithoutURLs(photos []Image) []string {
+	var missing []string
+	for _, p := range photos {
+		found := false
+		for _, d := range p.Derivatives {
+			if d.URL != nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, p.PhotoGUID)
+		}
+	}
+	return missing
+}
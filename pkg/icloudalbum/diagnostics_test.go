@@ -0,0 +1,137 @@
+// ABOUTME: Test suite for fetch diagnostics and strict diagnostics mode
+// ABOUTME: Covers asset URL failures, missing URLs, parse warnings and item count mismatches
+package icloudalbum
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCheckCounts(t *testing.T) {
+	n := func(v uint32) *Uint32OrString { u := Uint32OrString(v); return &u }
+	photos := []Image{{PhotoGUID: "a"}, {PhotoGUID: "b"}}
+
+	tests := []struct {
+		name     string
+		api      ApiResponse
+		mismatch bool
+	}{
+		{"all agree", ApiResponse{Photos: photos, PhotoGuids: []string{"a", "b"}, ItemsReturned: n(2)}, false},
+		{"fields absent", ApiResponse{Photos: photos}, false},
+		{"itemsReturned differs", ApiResponse{Photos: photos, ItemsReturned: n(3)}, true},
+		{"photoGuids differs", ApiResponse{Photos: photos, PhotoGuids: []string{"a"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkCounts(tt.api); (got != nil) != tt.mismatch {
+				t.Errorf("checkCounts() = %+v, want mismatch %v", got, tt.mismatch)
+			}
+		})
+	}
+}
+
+func newQuirkyAlbumServer(t *testing.T) string {
+	t.Helper()
+	srv := newFakeAlbumServer(t, fakeAlbum{
+		webstream: func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, map[string]any{
+				"streamName":    "Album",
+				"itemsReturned": 2,
+				"photos": []map[string]any{{
+					"photoGuid":   "guid1",
+					"derivatives": map[string]any{"1": map[string]any{"checksum": "sum1"}},
+				}},
+			})
+		},
+		webasseturls: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+		},
+	})
+	return srv.URL
+}
+
+func TestClient_FetchDiagnostics(t *testing.T) {
+	c := NewClient(WithBaseURL(newQuirkyAlbumServer(t)))
+
+	resp, err := c.Fetch(context.Background(), "B0aGWZuqDGKjsR")
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	d := resp.Diagnostics
+	if len(d.AssetURLErrors) != 1 {
+		t.Errorf("AssetURLErrors = %v, want the 400 failure", d.AssetURLErrors)
+	}
+	if len(d.MissingURLs) != 1 || d.MissingURLs[0] != "guid1" {
+		t.Errorf("MissingURLs = %v, want [guid1]", d.MissingURLs)
+	}
+	if d.CountMismatch == nil || d.CountMismatch.ItemsReturned != 2 || d.CountMismatch.Photos != 1 {
+		t.Errorf("CountMismatch = %+v", d.CountMismatch)
+	}
+	if d.Empty() {
+		t.Error("Empty() = true, want false")
+	}
+}
+
+func TestClient_FetchStrictDiagnostics(t *testing.T) {
+	c := NewClient(WithBaseURL(newQuirkyAlbumServer(t)), WithStrictDiagnostics(DiagAssetURLErrors))
+
+	_, err := c.Fetch(context.Background(), "B0aGWZuqDGKjsR")
+	var de *DiagnosticsError
+	if !errors.As(err, &de) {
+		t.Fatalf("Fetch() error = %v, want *DiagnosticsError", err)
+	}
+	if de.Kinds != DiagAssetURLErrors {
+		t.Errorf("Kinds = %b, want only DiagAssetURLErrors", de.Kinds)
+	}
+	var se *HTTPStatusError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusBadRequest {
+		t.Errorf("errors.As(*HTTPStatusError) should find the 400, got %v", se)
+	}
+}
+
+func TestClient_FetchParseWarnings(t *testing.T) {
+	srv := newFakeAlbumServer(t, fakeAlbum{
+		webstream: func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, map[string]any{
+				"streamName":    "Album",
+				"itemsReturned": "abc",
+				"photos": []map[string]any{{
+					"photoGuid": "guid1",
+					"width":     "wide",
+					"height":    "3024",
+					"derivatives": map[string]any{
+						"1": map[string]any{"checksum": "sum1", "fileSize": "big", "width": 4032},
+					},
+				}},
+			})
+		},
+		webasseturls: func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, map[string]any{"items": map[string]any{}, "locations": map[string]any{}})
+		},
+	})
+
+	resp, err := NewClient(WithBaseURL(srv.URL)).Fetch(context.Background(), "B0aGWZuqDGKjsR")
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	want := []string{"itemsReturned", "photos[0].width", `photos[0].derivatives["1"].fileSize`}
+	got := resp.Diagnostics.ParseWarnings
+	if len(got) != len(want) {
+		t.Fatalf("ParseWarnings = %q, want one each for %q", got, want)
+	}
+	for i, prefix := range want {
+		if !strings.HasPrefix(got[i], prefix+":") {
+			t.Errorf("ParseWarnings[%d] = %q, want prefix %q", i, got[i], prefix)
+		}
+	}
+
+	_, err = NewClient(WithBaseURL(srv.URL), WithStrictDiagnostics(DiagParseWarnings)).Fetch(context.Background(), "B0aGWZuqDGKjsR")
+	var de *DiagnosticsError
+	if !errors.As(err, &de) || de.Kinds != DiagParseWarnings {
+		t.Errorf("strict Fetch() error = %v, want *DiagnosticsError for parse warnings", err)
+	}
+}
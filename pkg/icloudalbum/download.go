@@ -1,10 +1,10 @@
-// ABOUTME: Downloads photos from iCloud with automatic format detection and filename sanitization
+// ABOUTME: Streams photos from iCloud to disk with format sniffing and resumable transfers
 // ABOUTME: Creates safe, descriptive filenames using GUIDs, captions, and indices
 package icloudalbum
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -23,33 +23,67 @@ func DownloadPhoto(photo *Image, index *int, outputDir string, customFilename *s
 	return DownloadPhotoWithClient(photo, index, outputDir, customFilename, downloadClient)
 }
 
+// DownloadPhotoContext is like DownloadPhoto but honors ctx for cancellation.
+func DownloadPhotoContext(ctx context.Context, photo *Image, index *int, outputDir string, customFilename *string) (string, error) {
+	return DownloadPhotoWithClientContext(ctx, photo, index, outputDir, customFilename, downloadClient)
+}
+
 // DownloadPhotoWithClient allows using a custom HTTP client for downloads.
 func DownloadPhotoWithClient(photo *Image, index *int, outputDir string, customFilename *string, client *http.Client) (string, error) {
+	return DownloadPhotoWithClientContext(context.Background(), photo, index, outputDir, customFilename, client)
+}
 
-	key, _, url, ok := SelectBestDerivative(photo.Derivatives)
-	if !ok || url == "" {
-		return "", fmt.Errorf("no suitable derivative found (key=%q)", key)
-	}
+// DownloadPhotoWithClientContext is like DownloadPhotoWithClient but honors ctx;
+// cancelling ctx aborts the request and the body read.
+func DownloadPhotoWithClientContext(ctx context.Context, photo *Image, index *int, outputDir string, customFilename *string, client *http.Client) (string, error) {
+	return NewClient(WithDownloadHTTPClient(client)).Download(ctx, photo, index, outputDir, customFilename)
+}
 
-	resp, err := client.Get(url)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return "", fmt.Errorf("download failed (status %d)", resp.StatusCode)
-	}
+// Download streams the derivative chosen by the client's DerivativeSelector to outputDir,
+// naming it the same way as DownloadPhoto. The file only appears under its final
+// name once fully written, and its modification time is set to the photo's
+// DateCreated (or BatchDateCreated).
+func (c *Client) Download(ctx context.Context, photo *Image, index *int, outputDir string, customFilename *string) (string, error) {
+	saved, err := c.download(ctx, photo, outputDir, c.legacyNamer(photo, index, outputDir, customFilename))
+	return saved.path, err
+}
 
-	content, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-	ext := GetExtensionForContent(content, "")
+// DownloadTo is like Download but names the file with tmpl, relative to outputDir.
+// index is the photo's 0-based position in the album.
+func (c *Client) DownloadTo(ctx context.Context, photo *Image, index int, outputDir string, tmpl *PathTemplate) (string, error) {
+	saved, err := c.download(ctx, photo, outputDir, c.templateNamer(photo, index, outputDir, tmpl))
+	return saved.path, err
+}
 
+// namer returns the absolute path a download is saved under for a given
+// extension ("" while the extension is not yet known).
+type namer func(ext string) (string, error)
+
+// savedFile describes a completed download.
+type savedFile struct {
+	path    string
+	key     string // derivative key that was fetched
+	bytes   int64
+	dateErr error // capture time could not be applied
+}
+
+func (c *Client) download(ctx context.Context, photo *Image, outputDir string, name namer) (savedFile, error) {
 	if err := os.MkdirAll(outputDir, 0o755); err != nil {
-		return "", err
+		return savedFile{}, err
+	}
+	saved, err := c.fetchToFile(ctx, photo, name)
+	if err != nil {
+		return saved, err
+	}
+	if saved.dateErr = applyCaptureTime(saved.path, photo); saved.dateErr != nil {
+		c.log(ctx).Warn("could not set file time from photo date", "guid", photo.PhotoGUID, "error", saved.dateErr)
 	}
+	return saved, nil
+}
 
+// legacyNamer names files as DownloadPhoto always has: GUID plus a sanitized
+// custom name, caption and/or 1-based index.
+func (c *Client) legacyNamer(photo *Image, index *int, outputDir string, customFilename *string) namer {
 	base := ""
 	switch {
 	case customFilename != nil && *customFilename != "":
@@ -66,11 +100,74 @@ func DownloadPhotoWithClient(photo *Image, index *int, outputDir string, customF
 		base = photo.PhotoGUID
 	}
 
-	fp := filepath.Join(outputDir, base+ext)
-	if err := os.WriteFile(fp, content, 0o644); err != nil {
-		return "", err
+	return func(ext string) (string, error) {
+		return filepath.Join(outputDir, c.profile.CleanName(base+ext)), nil
+	}
+}
+
+// templateNamer names files by expanding tmpl for the derivative that will be
+// downloaded.
+func (c *Client) templateNamer(photo *Image, index int, outputDir string, tmpl *PathTemplate) namer {
+	key, d, _, _ := c.selectDerivative(photo.Derivatives)
+	return func(ext string) (string, error) {
+		rel, err := tmpl.Expand(PathFields{Photo: photo, Index: index, DerivativeKey: key, Derivative: d, Ext: ext})
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(outputDir, c.profile.cleanPath(rel)), nil
+	}
+}
+
+// sniffLen is how much of a download is inspected to pick its extension;
+// it matches what http.DetectContentType considers.
+const sniffLen = 512
+
+// getDerivative starts the download of the selected derivative. Stale signed URLs
+// are refreshed first, and a 403/410 triggers one refresh and retry.
+// Extra request headers (such as Range) are sent with every attempt.
+func (c *Client) getDerivative(ctx context.Context, photo *Image, header http.Header) (*http.Response, string, Derivative, error) {
+	refreshed := false
+	attempts := 0 // download requests sent, across a URL refresh
+	for {
+		key, d, url, ok := c.selectDerivative(photo.Derivatives)
+		if !ok || url == "" {
+			return nil, "", Derivative{}, fmt.Errorf("%w (key=%q)", ErrNoDerivative, key)
+		}
+		if !refreshed && photo.assetBase != "" && c.urlStale(d, time.Now()) {
+			refreshed = true
+			if err := c.refreshPhotoURLs(ctx, photo); err != nil {
+				c.log(ctx).Warn("refreshing stale asset URL failed", "guid", photo.PhotoGUID, "error", err)
+			}
+			continue
+		}
+
+		pass := []int{http.StatusForbidden, http.StatusGone}
+		if header.Get("Range") != "" {
+			pass = append(pass, http.StatusRequestedRangeNotSatisfiable)
+		}
+		resp, err := c.do(ctx, apiCall{
+			endpoint:   EndpointDownload,
+			method:     "GET",
+			url:        url,
+			header:     header,
+			passStatus: pass,
+			attempts:   &attempts,
+		})
+		if err != nil {
+			return nil, key, d, err
+		}
+		if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusGone {
+			resp.Body.Close()
+			if !refreshed && photo.assetBase != "" {
+				refreshed = true
+				if err := c.refreshPhotoURLs(ctx, photo); err == nil {
+					continue
+				}
+			}
+			return nil, key, d, &HTTPStatusError{Endpoint: EndpointDownload, StatusCode: resp.StatusCode, Attempts: attempts, URL: redactURL(url)}
+		}
+		return resp, key, d, nil
 	}
-	return fp, nil
 }
 
 func sanitize(s string) string {
@@ -90,10 +187,11 @@ func sanitize(s string) string {
 	for _, r := range s {
 		out = append(out, repl(r))
 	}
-	if len(out) > 200 {
-		out = append(out[:195], []rune("_truncated")...)
-	}
 	trimmed := string(out)
+	// Limit bytes, not runes: 200 emoji would be 800 bytes.
+	if len(trimmed) > 200 {
+		trimmed = truncateName(trimmed, 190) + "_truncated"
+	}
 	trimmed = trimDots(trimmed)
 	return trimmed
 }
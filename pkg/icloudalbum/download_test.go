@@ -3,7 +3,15 @@
 package icloudalbum
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 )
 
@@ -87,3 +95,91 @@ func TestTrimDots(t *testing.T) {
 		})
 	}
 }
+
+// photoAt returns an Image whose only derivative points at url.
+func photoAt(guid, url string) *Image {
+	return &Image{
+		PhotoGUID:   guid,
+		Derivatives: map[string]Derivative{"original": {Checksum: "sum-" + guid, URL: &url}},
+	}
+}
+
+func TestClient_DownloadStreams(t *testing.T) {
+	// A PNG header followed by more data than the sniff buffer holds.
+	png := append([]byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}, bytes.Repeat([]byte{7}, 3*sniffLen)...)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/full":
+			_, _ = w.Write(png)
+		case "/tiny":
+			_, _ = w.Write([]byte{0xFF, 0xD8, 0xFF})
+		case "/truncated":
+			w.Header().Set("Content-Length", "100000")
+			_, _ = w.Write(png[:2*sniffLen])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+	}))
+	defer srv.Close()
+	c := NewClient(WithDownloadHTTPClient(srv.Client()), WithRetryConfig(fastRetry(0)), WithResumableDownloads(false))
+
+	tests := []struct {
+		name     string
+		path     string
+		wantFile string
+		wantLen  int
+		wantErr  bool
+	}{
+		{"large body streamed whole", "/full", "p.png", len(png), false},
+		{"body shorter than sniff buffer", "/tiny", "p.jpg", 3, false},
+		{"interrupted body leaves nothing behind", "/truncated", "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fp, err := c.Download(context.Background(), photoAt("p", srv.URL+tt.path), nil, dir, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Download() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			entries, _ := os.ReadDir(dir)
+			if tt.wantErr {
+				if len(entries) != 0 {
+					t.Errorf("output dir has %d entries after failure, want 0", len(entries))
+				}
+				return
+			}
+			if want := filepath.Join(dir, tt.wantFile); fp != want {
+				t.Errorf("Download() path = %q, want %q", fp, want)
+			}
+			if len(entries) != 1 {
+				t.Errorf("output dir has %d entries, want only the final file", len(entries))
+			}
+			info, err := os.Stat(fp)
+			if err != nil || info.Size() != int64(tt.wantLen) {
+				t.Fatalf("downloaded file stat = %v, %v; want %d bytes", info, err, tt.wantLen)
+			}
+			if info.Mode().Perm() != 0o644 {
+				t.Errorf("file mode = %v, want 0644", info.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestClient_DownloadCountsAttemptsOn403(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, "denied", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	c := NewClient(WithDownloadHTTPClient(srv.Client()), WithRetryConfig(fastRetry(3)))
+	_, err := c.Download(context.Background(), photoAt("g1", srv.URL+"/p"), nil, t.TempDir(), nil)
+	var se *HTTPStatusError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusForbidden || se.Attempts != 2 {
+		t.Errorf("Download() error = %v, want 403 after 2 attempts", err)
+	}
+}
@@ -0,0 +1,473 @@
+// ABOUTME: Concurrent album downloader with a worker pool and per-host connection limits
+// ABOUTME: Produces a DownloadReport with the outcome, size and timing of every photo
+package icloudalbum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDownloadConcurrency is the number of workers DownloadAlbum uses when
+// DownloadOptions.Concurrency is not set.
+const DefaultDownloadConcurrency = 4
+
+// manifestSaveInterval bounds how often DownloadAlbum rewrites the manifest as
+// photos finish, so a killed run loses at most this much recorded progress.
+var manifestSaveInterval = 2 * time.Second
+
+// DownloadOptions configures DownloadAlbum.
+type DownloadOptions struct {
+	// OutputDir receives the files.
+	OutputDir string
+	// Concurrency is the number of photos downloaded at once (default 4).
+	Concurrency int
+	// PerHostLimit caps concurrent downloads from any single asset host;
+	// zero means only Concurrency applies.
+	PerHostLimit int
+	// FailFast stops at the first failure: in-flight downloads are cancelled
+	// and remaining photos are not started. Otherwise every photo is attempted.
+	FailFast bool
+	// PathTemplate names files relative to OutputDir. When nil, files are
+	// named as DownloadPhoto names them.
+	PathTemplate *PathTemplate
+	// UseManifest keeps ManifestFileName in OutputDir, saved as photos finish
+	// and again at the end, so an interrupted run still counts. Photos whose
+	// file is recorded and verifies are skipped; changed, missing or corrupt
+	// ones are downloaded again.
+	UseManifest bool
+	// PostProcessors run in order on every newly downloaded file, e.g. to
+	// write sidecars. For photos skipped as unchanged, only those implementing
+	// Backfiller run, and only when they report their output missing.
+	PostProcessors []PostProcessor
+	// OnResult, if set, is called as each photo finishes. Calls are serialized.
+	OnResult func(PhotoResult)
+}
+
+// SavedPhoto describes a file DownloadAlbum has just written.
+type SavedPhoto struct {
+	Path          string
+	Photo         *Image
+	Album         *Metadata
+	DerivativeKey string
+	Location      *Location // the photo's own entry in Metadata.Locations, when present
+	// AlbumLocation is the album-wide entry in Metadata.Locations, if any. It
+	// says where the album is about, not where the photo was taken, so the
+	// built-in post-processors never write it as GPS.
+	AlbumLocation *Location
+}
+
+// PostProcessor runs on each newly downloaded file. A failure is reported in
+// PhotoResult.PostErr and does not fail the photo.
+type PostProcessor interface {
+	Process(ctx context.Context, saved SavedPhoto) error
+}
+
+// Backfiller is implemented by post-processors that should also run for
+// photos skipped as unchanged, e.g. because their sidecar was never written or
+// was deleted. NeedsBackfill reports whether saved lacks the processor's output.
+type Backfiller interface {
+	NeedsBackfill(saved SavedPhoto) bool
+}
+
+// DownloadOutcome says what happened to one photo.
+type DownloadOutcome string
+
+const (
+	OutcomeDownloaded DownloadOutcome = "downloaded"
+	OutcomeFailed     DownloadOutcome = "failed"
+	// OutcomeUnchanged marks photos skipped because the manifest shows their
+	// file is already on disk and intact.
+	OutcomeUnchanged DownloadOutcome = "unchanged"
+	// OutcomeCanceled marks photos not downloaded because the run was cancelled
+	// or stopped by FailFast.
+	OutcomeCanceled DownloadOutcome = "canceled"
+)
+
+// PhotoResult is the outcome of downloading one photo. Bytes is the size of
+// the file at Path. Manifest is empty unless DownloadOptions.UseManifest is set.
+// DateErr is set (without failing the photo) when a date could not be parsed
+// or applied as the file's modification time; PostErr when a post-processor
+// failed.
+type PhotoResult struct {
+	Index         int
+	PhotoGUID     string
+	Outcome       DownloadOutcome
+	Manifest      ManifestState
+	Path          string
+	DerivativeKey string
+	Bytes         int64
+	Duration      time.Duration
+	Err           error
+	DateErr       error
+	PostErr       error
+}
+
+// DownloadReport summarizes a DownloadAlbum run. Results are in album order.
+type DownloadReport struct {
+	Results    []PhotoResult
+	Downloaded int
+	Unchanged  int
+	Failed     int
+	Canceled   int
+	Bytes      int64
+	Duration   time.Duration
+}
+
+// Err joins the errors of all failed photos, or returns nil.
+func (r *DownloadReport) Err() error {
+	var errs []error
+	for _, res := range r.Results {
+		if res.Outcome == OutcomeFailed {
+			errs = append(errs, res.Err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DownloadAlbum downloads every photo in resp with a default Client.
+func DownloadAlbum(ctx context.Context, resp *ICloudResponse, opts DownloadOptions) (*DownloadReport, error) {
+	return NewClient().DownloadAlbum(ctx, resp, opts)
+}
+
+// DownloadAlbum downloads every photo in resp to opts.OutputDir using a pool of
+// workers. The report is always returned. The error is non-nil only when ctx is
+// cancelled, the manifest cannot be saved or, with FailFast, when a photo fails;
+// per-photo failures in continue mode are in the report (see DownloadReport.Err).
+func (c *Client) DownloadAlbum(ctx context.Context, resp *ICloudResponse, opts DownloadOptions) (*DownloadReport, error) {
+	start := time.Now()
+	workers := opts.Concurrency
+	if workers <= 0 {
+		workers = DefaultDownloadConcurrency
+	}
+	runCtx, stop := context.WithCancelCause(ctx)
+	defer stop(nil)
+
+	report := &DownloadReport{Results: make([]PhotoResult, len(resp.Photos))}
+	for i, p := range resp.Photos {
+		report.Results[i] = PhotoResult{Index: i, PhotoGUID: p.PhotoGUID, Outcome: OutcomeCanceled}
+	}
+
+	run := &albumRun{
+		c:         c,
+		opts:      opts,
+		limits:    newHostLimiter(opts.PerHostLimit),
+		album:     &resp.Metadata,
+		locations: ParseLocations(resp.Metadata.Locations),
+	}
+	if opts.UseManifest {
+		m, err := LoadManifest(opts.OutputDir)
+		if err != nil {
+			c.log(ctx).Warn("ignoring unreadable download manifest", "error", err)
+		}
+		run.manifest = m
+	}
+	run.reserveNames(resp.Photos)
+
+	var mu sync.Mutex // serializes OnResult
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if runCtx.Err() != nil {
+					continue // left as OutcomeCanceled
+				}
+				res := run.photo(runCtx, &resp.Photos[i], i)
+				report.Results[i] = res
+				if res.Outcome == OutcomeFailed && opts.FailFast {
+					stop(res.Err)
+				}
+				if opts.OnResult != nil {
+					mu.Lock()
+					opts.OnResult(res)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := range resp.Photos {
+		select {
+		case jobs <- i:
+		case <-runCtx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, res := range report.Results {
+		switch res.Outcome {
+		case OutcomeDownloaded:
+			report.Downloaded++
+			report.Bytes += res.Bytes
+		case OutcomeUnchanged:
+			report.Unchanged++
+		case OutcomeFailed:
+			report.Failed++
+		case OutcomeCanceled:
+			report.Canceled++
+		}
+	}
+	report.Duration = time.Since(start)
+
+	var saveErr error
+	if run.manifest != nil {
+		saveErr = run.saveManifest(true)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+	if opts.FailFast && report.Failed > 0 {
+		return report, context.Cause(runCtx)
+	}
+	return report, saveErr
+}
+
+// albumRun holds what the workers of one DownloadAlbum call share.
+type albumRun struct {
+	c        *Client
+	opts     DownloadOptions
+	limits   *hostLimiter
+	manifest *Manifest // nil unless opts.UseManifest
+	names    []namer   // per photo, with collisions already resolved
+
+	album     *Metadata
+	locations Locations
+
+	saveMu   sync.Mutex // serializes manifest saves
+	lastSave time.Time
+}
+
+// saveManifest writes the manifest when force is set or manifestSaveInterval
+// has passed since the last save. Saves are serialized so an older snapshot
+// never replaces a newer one.
+func (r *albumRun) saveManifest(force bool) error {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	if !force && time.Since(r.lastSave) < manifestSaveInterval {
+		return nil
+	}
+	if err := os.MkdirAll(r.opts.OutputDir, 0o755); err != nil {
+		return err
+	}
+	if err := r.manifest.Save(r.opts.OutputDir); err != nil {
+		return fmt.Errorf("saving download manifest: %w", err)
+	}
+	r.lastSave = time.Now()
+	return nil
+}
+
+// namer returns how the photo at index is named before collision handling.
+func (r *albumRun) namer(photo *Image, index int) namer {
+	if r.opts.PathTemplate != nil {
+		return r.c.templateNamer(photo, index, r.opts.OutputDir, r.opts.PathTemplate)
+	}
+	return r.c.legacyNamer(photo, &index, r.opts.OutputDir, nil)
+}
+
+// reserveNames assigns every photo a name no other photo and no unrelated file
+// on disk uses. Names recorded in the manifest stay with their photo; the rest
+// are resolved in album order, so the outcome does not depend on download
+// timing. A file on disk is taken as the photo's own earlier download when the
+// manifest records it for that photo or its size matches the derivative that
+// would be downloaded, so re-runs reuse their names instead of adding copies.
+// Without UseManifest an existing manifest is still read for this.
+func (r *albumRun) reserveNames(photos []Image) {
+	names := newNameReserver(r.c.profile)
+	claims := r.manifest
+	if claims == nil {
+		claims, _ = LoadManifest(r.opts.OutputDir)
+	}
+	for guid, e := range claims.Photos {
+		if filepath.IsLocal(filepath.FromSlash(e.Path)) {
+			p := filepath.Join(r.opts.OutputDir, filepath.FromSlash(e.Path))
+			names.claim(guid, strings.TrimSuffix(p, filepath.Ext(p)))
+		}
+	}
+	r.names = make([]namer, len(photos))
+	for i := range photos {
+		name := r.namer(&photos[i], i)
+		if stem, err := name(""); err == nil {
+			name = withSuffix(name, stem, names.reserve(photos[i].PhotoGUID, stem, r.ownFile(&photos[i])))
+		}
+		r.names[i] = name
+	}
+}
+
+// ownFile returns a check for whether an unclaimed file on disk is photo's own
+// earlier download: its size must match the selected derivative's. Apple's
+// checksum is not a content hash, so size is the only evidence available
+// without a manifest. It returns nil when the size is unknown.
+func (r *albumRun) ownFile(photo *Image) func(path string) bool {
+	_, d, _, ok := r.c.selectDerivative(photo.Derivatives)
+	if !ok || fileSizeOf(d) == 0 {
+		return nil
+	}
+	want := int64(fileSizeOf(d))
+	return func(path string) bool {
+		info, err := os.Stat(path)
+		return err == nil && info.Mode().IsRegular() && info.Size() == want
+	}
+}
+
+func (r *albumRun) photo(ctx context.Context, photo *Image, index int) PhotoResult {
+	start := time.Now()
+	res := PhotoResult{Index: index, PhotoGUID: photo.PhotoGUID}
+	dir := r.opts.OutputDir
+
+	host, checksum := "", ""
+	if _, d, url, ok := r.c.selectDerivative(photo.Derivatives); ok {
+		host, checksum = hostOf(url), d.Checksum
+	}
+
+	var prev ManifestEntry
+	if r.manifest != nil {
+		res.Manifest, prev = r.manifest.check(dir, photo.PhotoGUID, checksum)
+		if res.Manifest == ManifestUnchanged {
+			res.Outcome = OutcomeUnchanged
+			res.Path = filepath.Join(dir, filepath.FromSlash(prev.Path))
+			res.DerivativeKey, res.Bytes = prev.DerivativeKey, prev.Size
+			r.backfill(ctx, photo, &res, prev)
+			res.Duration = time.Since(start)
+			return res
+		}
+	}
+
+	release, err := r.limits.acquire(ctx, host)
+	if err == nil {
+		var saved savedFile
+		saved, err = r.c.download(ctx, photo, dir, r.names[index])
+		release()
+		res.Path, res.DerivativeKey, res.Bytes, res.DateErr = saved.path, saved.key, saved.bytes, saved.dateErr
+	}
+	if err == nil {
+		res.PostErr = r.postProcess(ctx, photo, res)
+	}
+	if err == nil && r.manifest != nil {
+		entry := ManifestEntry{Checksum: photo.Derivatives[res.DerivativeKey].Checksum, DerivativeKey: res.DerivativeKey}
+		err = r.manifest.record(dir, photo.PhotoGUID, entry, res.Path)
+		if old := filepath.FromSlash(prev.Path); err == nil && res.Manifest == ManifestChanged && filepath.IsLocal(old) && filepath.Join(dir, old) != res.Path {
+			os.Remove(filepath.Join(dir, old))
+		}
+		if err == nil {
+			if err := r.saveManifest(false); err != nil {
+				r.c.log(ctx).Warn("could not save download manifest", "error", err)
+			}
+		}
+	}
+	res.Duration = time.Since(start)
+
+	switch {
+	case err == nil:
+		res.Outcome = OutcomeDownloaded
+	case ctx.Err() != nil:
+		res.Outcome, res.Err = OutcomeCanceled, err
+	default:
+		res.Outcome, res.Err = OutcomeFailed, err
+		r.c.log(ctx).Warn("photo download failed", "guid", photo.PhotoGUID, "error", err)
+	}
+	return res
+}
+
+// postProcess runs the configured post-processors on a saved photo and joins
+// their errors.
+func (r *albumRun) postProcess(ctx context.Context, photo *Image, res PhotoResult) error {
+	return r.runProcessors(ctx, photo, res, r.opts.PostProcessors)
+}
+
+// backfill runs the Backfiller post-processors whose output is missing for an
+// unchanged photo, then re-records the photo in the manifest in case one of
+// them rewrote the file itself.
+func (r *albumRun) backfill(ctx context.Context, photo *Image, res *PhotoResult, prev ManifestEntry) {
+	saved := r.savedPhoto(photo, *res)
+	var todo []PostProcessor
+	for _, p := range r.opts.PostProcessors {
+		if b, ok := p.(Backfiller); ok && b.NeedsBackfill(saved) {
+			todo = append(todo, p)
+		}
+	}
+	if len(todo) == 0 {
+		return
+	}
+	res.PostErr = r.runProcessors(ctx, photo, *res, todo)
+	entry := ManifestEntry{Checksum: prev.Checksum, DerivativeKey: prev.DerivativeKey}
+	if err := r.manifest.record(r.opts.OutputDir, photo.PhotoGUID, entry, res.Path); err != nil {
+		res.PostErr = errors.Join(res.PostErr, err)
+		return
+	}
+	if err := r.saveManifest(false); err != nil {
+		r.c.log(ctx).Warn("could not save download manifest", "error", err)
+	}
+}
+
+func (r *albumRun) savedPhoto(photo *Image, res PhotoResult) SavedPhoto {
+	saved := SavedPhoto{Path: res.Path, Photo: photo, Album: r.album, DerivativeKey: res.DerivativeKey}
+	if loc, ok := r.locations.For(photo.PhotoGUID); ok {
+		saved.Location = &loc
+	}
+	if loc, ok := r.locations.Album(); ok {
+		saved.AlbumLocation = &loc
+	}
+	return saved
+}
+
+func (r *albumRun) runProcessors(ctx context.Context, photo *Image, res PhotoResult, procs []PostProcessor) error {
+	if len(procs) == 0 {
+		return nil
+	}
+	saved := r.savedPhoto(photo, res)
+	var errs []error
+	for _, p := range procs {
+		if err := p.Process(ctx, saved); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	err := errors.Join(errs...)
+	if err != nil {
+		r.c.log(ctx).Warn("post-processing failed", "guid", photo.PhotoGUID, "error", err)
+	}
+	return err
+}
+
+// hostLimiter bounds concurrent downloads per host. A nil limiter, or one with
+// a zero limit, admits everything.
+type hostLimiter struct {
+	limit int
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func newHostLimiter(limit int) *hostLimiter {
+	return &hostLimiter{limit: limit, slots: map[string]chan struct{}{}}
+}
+
+func (l *hostLimiter) acquire(ctx context.Context, host string) (release func(), err error) {
+	if l == nil || l.limit <= 0 {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	sem, ok := l.slots[host]
+	if !ok {
+		sem = make(chan struct{}, l.limit)
+		l.slots[host] = sem
+	}
+	l.mu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
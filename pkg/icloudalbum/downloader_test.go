@@ -0,0 +1,146 @@
+// ABOUTME: Test suite for the concurrent album downloader
+// ABOUTME: Covers concurrency and per-host limits, fail-fast and continue-on-error modes
+package icloudalbum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// albumOf builds a response with n photos served from srv at /p<i>.
+func albumOf(srv *httptest.Server, n int) *ICloudResponse {
+	resp := &ICloudResponse{}
+	for i := 0; i < n; i++ {
+		resp.Photos = append(resp.Photos, *photoAt(fmt.Sprintf("g%d", i), fmt.Sprintf("%s/p%d", srv.URL, i)))
+	}
+	return resp
+}
+
+func TestClient_DownloadAlbum_Limits(t *testing.T) {
+	tests := []struct {
+		name         string
+		concurrency  int
+		perHost      int
+		wantMaxAbove int // in-flight must reach at least this
+		wantMax      int // and never exceed this
+	}{
+		{"concurrency bounds workers", 3, 0, 2, 3},
+		{"per-host limit below concurrency", 4, 1, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inFlight, peak atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := inFlight.Add(1)
+				defer inFlight.Add(-1)
+				for {
+					p := peak.Load()
+					if n <= p || peak.CompareAndSwap(p, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				_, _ = w.Write([]byte{0xFF, 0xD8, 0xFF})
+			}))
+			defer srv.Close()
+
+			c := NewClient(WithDownloadHTTPClient(srv.Client()))
+			report, err := c.DownloadAlbum(context.Background(), albumOf(srv, 8), DownloadOptions{
+				OutputDir:    t.TempDir(),
+				Concurrency:  tt.concurrency,
+				PerHostLimit: tt.perHost,
+			})
+			if err != nil || report.Downloaded != 8 {
+				t.Fatalf("DownloadAlbum() = %+v, %v; want 8 downloaded", report, err)
+			}
+			if got := int(peak.Load()); got < tt.wantMaxAbove || got > tt.wantMax {
+				t.Errorf("peak concurrent downloads = %d, want between %d and %d", got, tt.wantMaxAbove, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestClient_DownloadAlbum_ContinueOnError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/p2" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte{0xFF, 0xD8, 0xFF, 0xE0})
+	}))
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var seen []string
+	dir := t.TempDir()
+	c := NewClient(WithDownloadHTTPClient(srv.Client()), WithRetryConfig(fastRetry(0)))
+	report, err := c.DownloadAlbum(context.Background(), albumOf(srv, 5), DownloadOptions{
+		OutputDir: dir,
+		OnResult: func(r PhotoResult) {
+			mu.Lock()
+			seen = append(seen, r.PhotoGUID)
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatalf("DownloadAlbum() error = %v, want nil in continue mode", err)
+	}
+	if report.Downloaded != 4 || report.Failed != 1 || report.Canceled != 0 || report.Bytes != 16 {
+		t.Errorf("report = %+v, want 4 downloaded (16 bytes), 1 failed", report)
+	}
+	if len(seen) != 5 {
+		t.Errorf("OnResult called %d times, want 5", len(seen))
+	}
+	for i, res := range report.Results {
+		if res.Index != i || res.PhotoGUID != fmt.Sprintf("g%d", i) {
+			t.Errorf("Results[%d] = %+v, out of album order", i, res)
+		}
+		if i == 2 {
+			var se *HTTPStatusError
+			if res.Outcome != OutcomeFailed || !errors.As(res.Err, &se) || se.StatusCode != http.StatusNotFound {
+				t.Errorf("Results[2] = %+v, want failed with 404", res)
+			}
+			continue
+		}
+		want := filepath.Join(dir, fmt.Sprintf("%d_g%d.jpg", i+1, i))
+		if res.Outcome != OutcomeDownloaded || res.Path != want || res.DerivativeKey != "original" || res.Bytes != 4 {
+			t.Errorf("Results[%d] = %+v, want downloaded to %s", i, res, want)
+		}
+	}
+	if report.Err() == nil {
+		t.Error("report.Err() should describe the failed photo")
+	}
+}
+
+func TestClient_DownloadAlbum_FailFast(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/p0" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte{0xFF, 0xD8, 0xFF})
+	}))
+	defer srv.Close()
+
+	c := NewClient(WithDownloadHTTPClient(srv.Client()), WithRetryConfig(fastRetry(0)))
+	report, err := c.DownloadAlbum(context.Background(), albumOf(srv, 4), DownloadOptions{
+		OutputDir:   t.TempDir(),
+		Concurrency: 1,
+		FailFast:    true,
+	})
+	var se *HTTPStatusError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusNotFound {
+		t.Fatalf("DownloadAlbum() error = %v, want the first failure", err)
+	}
+	if report.Failed != 1 || report.Downloaded != 0 || report.Canceled != 3 {
+		t.Errorf("report = %+v, want 1 failed and 3 canceled", report)
+	}
+}
@@ -0,0 +1,136 @@
+// ABOUTME: Typed errors for iCloud album failures that callers can inspect
+// ABOUTME: Sentinels work with errors.Is; HTTPStatusError carries request details for errors.As
+package icloudalbum
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrAlbumNotFound means the album does not exist or was deleted.
+	ErrAlbumNotFound = errors.New("album not found")
+	// ErrAlbumPrivate means the album is no longer shared publicly.
+	ErrAlbumPrivate = errors.New("album is private")
+	// ErrRateLimited means Apple throttled the request.
+	ErrRateLimited = errors.New("rate limited")
+	// ErrMissingStreamName means webstream answered without the required streamName.
+	ErrMissingStreamName = errors.New("missing required field: streamName")
+	// ErrNoDerivative means a photo has no derivative with a URL to download.
+	ErrNoDerivative = errors.New("no suitable derivative found")
+	// ErrRedirectLoop means webstream redirects led back to a host already visited.
+	ErrRedirectLoop = errors.New("webstream redirect loop")
+	// ErrTooManyRedirects means webstream redirects exceeded the client's limit.
+	ErrTooManyRedirects = errors.New("too many webstream redirects")
+)
+
+// AssetURLError reports a webasseturls batch that failed after retries (and,
+// for 400s, after bisecting down to a single GUID).
+type AssetURLError struct {
+	GUIDs []string
+	Err   error
+}
+
+func (e *AssetURLError) Error() string {
+	if len(e.GUIDs) == 1 {
+		return fmt.Sprintf("asset URLs for %s: %v", e.GUIDs[0], e.Err)
+	}
+	return fmt.Sprintf("asset URLs for %d GUIDs: %v", len(e.GUIDs), e.Err)
+}
+
+func (e *AssetURLError) Unwrap() error { return e.Err }
+
+// DateError reports a photo timestamp that could not be parsed.
+type DateError struct {
+	PhotoGUID string
+	Field     string // "dateCreated" or "batchDateCreated"
+	Value     string
+}
+
+func (e *DateError) Error() string {
+	return fmt.Sprintf("photo %s: unparseable %s %q", e.PhotoGUID, e.Field, e.Value)
+}
+
+// RedirectError wraps ErrRedirectLoop or ErrTooManyRedirects with the hosts visited.
+type RedirectError struct {
+	Err   error
+	Chain []string
+}
+
+func (e *RedirectError) Error() string {
+	return fmt.Sprintf("%v: %s", e.Err, strings.Join(e.Chain, " -> "))
+}
+
+func (e *RedirectError) Unwrap() error { return e.Err }
+
+// HTTPStatusError reports a request that ended with an unexpected HTTP status,
+// after any retries. It matches ErrAlbumNotFound, ErrAlbumPrivate and
+// ErrRateLimited through errors.Is where the status implies them.
+type HTTPStatusError struct {
+	Endpoint   Endpoint
+	StatusCode int
+	Attempts   int
+	// URL is the request URL with the album token, query and credentials removed.
+	URL string
+	// RetryAfter is the delay the server asked for via Retry-After, if any.
+	RetryAfter time.Duration
+}
+
+func (e *HTTPStatusError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s request failed (status %d", e.Endpoint, e.StatusCode)
+	if e.Attempts > 1 {
+		fmt.Fprintf(&b, " after %d attempts", e.Attempts)
+	}
+	if e.RetryAfter > 0 {
+		fmt.Fprintf(&b, ", server asked to retry after %s", e.RetryAfter)
+	}
+	b.WriteString(")")
+	if e.URL != "" {
+		b.WriteString(": " + e.URL)
+	}
+	return b.String()
+}
+
+// Is reports whether the status maps to one of the package sentinels.
+func (e *HTTPStatusError) Is(target error) bool {
+	switch target {
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrAlbumNotFound:
+		return e.Endpoint == EndpointWebstream &&
+			(e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone)
+	case ErrAlbumPrivate:
+		return e.Endpoint == EndpointWebstream &&
+			(e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden)
+	}
+	return false
+}
+
+// redactURL strips credentials, query and fragment, and replaces every path
+// segment other than the fixed API names so tokens and signatures never leak
+// into logs or alerts.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "REDACTED"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	segs := strings.Split(u.Path, "/")
+	for i, s := range segs {
+		switch s {
+		case "", "sharedstreams", "webstream", "webasseturls":
+		default:
+			segs[i] = "REDACTED"
+		}
+	}
+	u.Path = strings.Join(segs, "/")
+	u.RawPath = ""
+	return u.String()
+}
@@ -0,0 +1,389 @@
+// ABOUTME: Opt-in post-processor that writes caption, capture date and contributor into JPEG EXIF
+// ABOUTME: Appends new IFDs inside the APP1 block so pixel data and existing offsets stay untouched
+package icloudalbum
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrEXIFUnsafe means a JPEG's EXIF could not be rewritten safely; the file
+// was left unchanged.
+var ErrEXIFUnsafe = errors.New("EXIF cannot be rewritten safely")
+
+// EXIFWriter is an opt-in PostProcessor that sets ImageDescription (caption),
+// Artist (contributor) and, when the camera left it blank, DateTimeOriginal
+// (from DateCreated) in downloaded JPEGs. Only the APP1 EXIF segment changes;
+// other files are skipped, and JPEGs whose EXIF cannot be rewritten safely are
+// left unchanged and reported with ErrEXIFUnsafe.
+type EXIFWriter struct{}
+
+// EXIF tags written or followed by EXIFWriter.
+const (
+	tagImageDescription   = 0x010E
+	tagArtist             = 0x013B
+	tagExifIFD            = 0x8769
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+)
+
+// Process rewrites the EXIF of saved.Path in place, keeping its file times.
+func (EXIFWriter) Process(_ context.Context, saved SavedPhoto) error {
+	u := exifUpdateFor(saved.Photo)
+	if u == (exifUpdate{}) {
+		return nil
+	}
+
+	f, err := os.Open(saved.Path)
+	if err != nil {
+		return err
+	}
+	magic := make([]byte, 2)
+	_, err = io.ReadFull(f, magic)
+	f.Close()
+	if err != nil || magic[0] != 0xFF || magic[1] != 0xD8 {
+		return nil // not a JPEG
+	}
+
+	data, err := os.ReadFile(saved.Path)
+	if err != nil {
+		return err
+	}
+	out, err := rewriteJPEGEXIF(data, u)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(saved.Path), err)
+	}
+	if out == nil {
+		return nil
+	}
+
+	info, err := os.Stat(saved.Path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(saved.Path), "."+filepath.Base(saved.Path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime()); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), saved.Path)
+}
+
+// NeedsBackfill reports whether saved is a JPEG whose EXIF can be safely
+// updated and still lacks the photo's caption, contributor or capture date.
+func (EXIFWriter) NeedsBackfill(saved SavedPhoto) bool {
+	u := exifUpdateFor(saved.Photo)
+	if u == (exifUpdate{}) {
+		return false
+	}
+	data, err := os.ReadFile(saved.Path)
+	if err != nil || len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return false
+	}
+	out, err := rewriteJPEGEXIF(data, u)
+	return err == nil && out != nil
+}
+
+func exifUpdateFor(photo *Image) exifUpdate {
+	u := exifUpdate{description: derefOr(photo.Caption, ""), artist: photo.Contributor()}
+	if t, err := parseAppleDate(derefOr(photo.DateCreated, "")); err == nil {
+		u.taken = t
+	}
+	return u
+}
+
+// exifUpdate is what EXIFWriter wants recorded; empty fields are left alone.
+type exifUpdate struct {
+	description string
+	artist      string
+	taken       time.Time
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+func exifUnsafe(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrEXIFUnsafe, fmt.Sprintf(format, args...))
+}
+
+// rewriteJPEGEXIF returns data with its EXIF updated, or nil when nothing needs
+// to change. Only the segments before the first SOS are inspected; everything
+// outside the EXIF APP1 segment is copied byte for byte.
+func rewriteJPEGEXIF(data []byte, u exifUpdate) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, exifUnsafe("not a JPEG")
+	}
+	start, end := -1, -1
+	insertAt := 2
+	for pos := 2; ; {
+		if pos+2 > len(data) || data[pos] != 0xFF {
+			return nil, exifUnsafe("malformed segment at offset %d", pos)
+		}
+		marker := data[pos+1]
+		if marker == 0xFF { // fill byte
+			pos++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 { // SOS or EOI: headers are over
+			break
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			pos += 2
+			continue
+		}
+		if pos+4 > len(data) {
+			return nil, exifUnsafe("truncated segment at offset %d", pos)
+		}
+		n := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if n < 2 || pos+2+n > len(data) {
+			return nil, exifUnsafe("segment length out of range at offset %d", pos)
+		}
+		body := data[pos+4 : pos+2+n]
+		if marker == 0xE0 && pos == 2 {
+			insertAt = pos + 2 + n // keep JFIF APP0 first
+		}
+		if marker == 0xE1 && bytes.HasPrefix(body, exifHeader) {
+			if start >= 0 {
+				return nil, exifUnsafe("multiple EXIF segments")
+			}
+			start, end = pos, pos+2+n
+		}
+		pos += 2 + n
+	}
+
+	var tiff []byte
+	if start >= 0 {
+		tiff = data[start+4+len(exifHeader) : end]
+	} else {
+		// An empty big-endian TIFF: header plus an IFD0 with no entries.
+		tiff = []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0}
+		start, end = insertAt, insertAt
+	}
+	newTIFF, err := updateTIFF(tiff, u)
+	if err != nil || newTIFF == nil {
+		return nil, err
+	}
+
+	segLen := 2 + len(exifHeader) + len(newTIFF)
+	if segLen > 0xFFFF {
+		return nil, exifUnsafe("EXIF block would exceed 64 KiB")
+	}
+	out := make([]byte, 0, len(data)-(end-start)+2+segLen)
+	out = append(out, data[:start]...)
+	out = append(out, 0xFF, 0xE1, byte(segLen>>8), byte(segLen))
+	out = append(out, exifHeader...)
+	out = append(out, newTIFF...)
+	return append(out, data[end:]...), nil
+}
+
+// ifdEntry is one raw 12-byte IFD entry.
+type ifdEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value [4]byte // inline value or offset, in the TIFF's byte order
+}
+
+// updateTIFF applies u to a TIFF block and returns the new block, or nil when
+// nothing changes. The original bytes are kept verbatim; changed IFDs are
+// appended as copies and the header (or parent pointer) is repointed, so every
+// existing offset, including those inside maker notes, stays valid.
+func updateTIFF(tiff []byte, u exifUpdate) ([]byte, error) {
+	if len(tiff) < 8 {
+		return nil, exifUnsafe("TIFF header truncated")
+	}
+	var bo binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return nil, exifUnsafe("unknown TIFF byte order")
+	}
+	if bo.Uint16(tiff[2:]) != 42 {
+		return nil, exifUnsafe("bad TIFF magic")
+	}
+	ifd0, next0, err := readIFD(tiff, bo, bo.Uint32(tiff[4:]))
+	if err != nil {
+		return nil, err
+	}
+
+	out := append([]byte(nil), tiff...)
+	var ifd0Changes []ifdEntry
+	for _, s := range []struct {
+		tag   uint16
+		value string
+	}{
+		{tagImageDescription, u.description},
+		{tagArtist, u.artist},
+	} {
+		if s.value == "" {
+			continue
+		}
+		if cur, ok := findEntry(ifd0, s.tag); ok {
+			if v, err := entryString(tiff, bo, cur); err == nil && v == s.value {
+				continue
+			}
+		}
+		ifd0Changes = append(ifd0Changes, asciiEntry(&out, bo, s.tag, s.value))
+	}
+
+	if !u.taken.IsZero() {
+		var exifIFD []ifdEntry
+		var exifNext uint32
+		if ptr, ok := findEntry(ifd0, tagExifIFD); ok {
+			if exifIFD, exifNext, err = readIFD(tiff, bo, bo.Uint32(ptr.value[:])); err != nil {
+				return nil, err
+			}
+		}
+		cur, ok := findEntry(exifIFD, tagDateTimeOriginal)
+		blank := !ok
+		if ok {
+			v, err := entryString(tiff, bo, cur)
+			if err != nil {
+				return nil, err
+			}
+			blank = strings.Trim(v, " 0:\x00") == ""
+		}
+		if blank {
+			changes := []ifdEntry{asciiEntry(&out, bo, tagDateTimeOriginal, u.taken.Format("2006:01:02 15:04:05"))}
+			if _, ok := findEntry(exifIFD, tagOffsetTimeOriginal); !ok {
+				changes = append(changes, asciiEntry(&out, bo, tagOffsetTimeOriginal, u.taken.Format("-07:00")))
+			}
+			off := appendIFD(&out, bo, mergeEntries(exifIFD, changes), exifNext)
+			ptr := ifdEntry{tag: tagExifIFD, typ: 4, count: 1}
+			bo.PutUint32(ptr.value[:], off)
+			ifd0Changes = append(ifd0Changes, ptr)
+		}
+	}
+
+	if len(ifd0Changes) == 0 {
+		return nil, nil
+	}
+	off := appendIFD(&out, bo, mergeEntries(ifd0, ifd0Changes), next0)
+	bo.PutUint32(out[4:], off)
+	return out, nil
+}
+
+// readIFD parses the IFD at off, returning its entries and next-IFD offset.
+func readIFD(tiff []byte, bo binary.ByteOrder, off uint32) ([]ifdEntry, uint32, error) {
+	if uint64(off)+2 > uint64(len(tiff)) {
+		return nil, 0, exifUnsafe("IFD offset %d out of range", off)
+	}
+	n := int(bo.Uint16(tiff[off:]))
+	end := int(off) + 2 + 12*n
+	if n > 1000 || end+4 > len(tiff) {
+		return nil, 0, exifUnsafe("IFD at %d has implausible size", off)
+	}
+	entries := make([]ifdEntry, n)
+	for i := range entries {
+		p := tiff[int(off)+2+12*i:]
+		entries[i] = ifdEntry{tag: bo.Uint16(p), typ: bo.Uint16(p[2:]), count: bo.Uint32(p[4:])}
+		copy(entries[i].value[:], p[8:12])
+	}
+	return entries, bo.Uint32(tiff[end:]), nil
+}
+
+func findEntry(entries []ifdEntry, tag uint16) (ifdEntry, bool) {
+	for _, e := range entries {
+		if e.tag == tag {
+			return e, true
+		}
+	}
+	return ifdEntry{}, false
+}
+
+// entryString reads an ASCII entry, trimming trailing NULs.
+func entryString(tiff []byte, bo binary.ByteOrder, e ifdEntry) (string, error) {
+	if e.typ != 2 {
+		return "", exifUnsafe("tag 0x%04X is not ASCII", e.tag)
+	}
+	var b []byte
+	if e.count <= 4 {
+		b = e.value[:e.count]
+	} else {
+		off := bo.Uint32(e.value[:])
+		if uint64(off)+uint64(e.count) > uint64(len(tiff)) {
+			return "", exifUnsafe("tag 0x%04X value out of range", e.tag)
+		}
+		b = tiff[off : off+e.count]
+	}
+	return strings.TrimRight(string(b), "\x00"), nil
+}
+
+// asciiEntry builds an ASCII entry for s, appending its value to out when it
+// does not fit inline.
+func asciiEntry(out *[]byte, bo binary.ByteOrder, tag uint16, s string) ifdEntry {
+	v := append([]byte(s), 0)
+	e := ifdEntry{tag: tag, typ: 2, count: uint32(len(v))}
+	if len(v) <= 4 {
+		copy(e.value[:], v)
+		return e
+	}
+	bo.PutUint32(e.value[:], appendAligned(out, v))
+	return e
+}
+
+// mergeEntries replaces or adds changes in entries, sorted by tag as TIFF requires.
+func mergeEntries(entries, changes []ifdEntry) []ifdEntry {
+	merged := make([]ifdEntry, 0, len(entries)+len(changes))
+	for _, e := range entries {
+		if _, replaced := findEntry(changes, e.tag); !replaced {
+			merged = append(merged, e)
+		}
+	}
+	merged = append(merged, changes...)
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].tag < merged[j].tag })
+	return merged
+}
+
+// appendIFD serializes an IFD at the end of out and returns its offset.
+func appendIFD(out *[]byte, bo binary.ByteOrder, entries []ifdEntry, next uint32) uint32 {
+	b := make([]byte, 2+12*len(entries)+4)
+	bo.PutUint16(b, uint16(len(entries)))
+	for i, e := range entries {
+		p := b[2+12*i:]
+		bo.PutUint16(p, e.tag)
+		bo.PutUint16(p[2:], e.typ)
+		bo.PutUint32(p[4:], e.count)
+		copy(p[8:12], e.value[:])
+	}
+	bo.PutUint32(b[len(b)-4:], next)
+	return appendAligned(out, b)
+}
+
+// appendAligned appends b at an even offset and returns that offset.
+func appendAligned(out *[]byte, b []byte) uint32 {
+	if len(*out)%2 == 1 {
+		*out = append(*out, 0)
+	}
+	off := uint32(len(*out))
+	*out = append(*out, b...)
+	return off
+}
@@ -0,0 +1,383 @@
+// ABOUTME: Test suite for the JPEG EXIF writer
+// ABOUTME: Checks tag round-trips, preserved pixel data and offsets, and that unsafe files are left alone
+package icloudalbum
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// scanData stands in for entropy-coded pixel data after SOS.
+var scanData = []byte{0xFF, 0xDA, 0x00, 0x08, 1, 2, 3, 4, 5, 6, 0x12, 0x34, 0xFF, 0x00, 0x56, 0xFF, 0xD9}
+
+// testJPEG assembles SOI, the given header segments and scanData.
+func testJPEG(segments ...[]byte) []byte {
+	out := []byte{0xFF, 0xD8}
+	for _, s := range segments {
+		out = append(out, s...)
+	}
+	return append(out, scanData...)
+}
+
+func segment(marker byte, body []byte) []byte {
+	n := len(body) + 2
+	return append([]byte{0xFF, marker, byte(n >> 8), byte(n)}, body...)
+}
+
+var jfifSegment = segment(0xE0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"))
+
+// cameraEXIF builds a little-endian APP1 whose IFD0 holds Make (stored out of
+// line) and an Exif IFD with the given DateTimeOriginal.
+func cameraEXIF(taken string) []byte {
+	bo := binary.LittleEndian
+	tiff := []byte{'I', 'I', 42, 0, 8, 0, 0, 0}
+	// IFD0 at 8: Make, ExifIFD pointer.
+	ifd0 := make([]byte, 2+2*12+4)
+	makeOff := uint32(8 + len(ifd0))
+	maker := []byte("Apple Inc.\x00")
+	exifOff := makeOff + uint32(len(maker)) + 1
+	bo.PutUint16(ifd0, 2)
+	bo.PutUint16(ifd0[2:], 0x010F)
+	bo.PutUint16(ifd0[4:], 2)
+	bo.PutUint32(ifd0[6:], uint32(len(maker)))
+	bo.PutUint32(ifd0[10:], makeOff)
+	bo.PutUint16(ifd0[14:], tagExifIFD)
+	bo.PutUint16(ifd0[16:], 4)
+	bo.PutUint32(ifd0[18:], 1)
+	bo.PutUint32(ifd0[22:], exifOff)
+	tiff = append(tiff, ifd0...)
+	tiff = append(tiff, maker...)
+	tiff = append(tiff, 0)
+	// Exif IFD: DateTimeOriginal.
+	exif := make([]byte, 2+12+4)
+	dto := append([]byte(taken), 0)
+	bo.PutUint16(exif, 1)
+	bo.PutUint16(exif[2:], tagDateTimeOriginal)
+	bo.PutUint16(exif[4:], 2)
+	bo.PutUint32(exif[6:], uint32(len(dto)))
+	bo.PutUint32(exif[10:], exifOff+uint32(len(exif)))
+	tiff = append(tiff, exif...)
+	tiff = append(tiff, dto...)
+	return segment(0xE1, append([]byte("Exif\x00\x00"), tiff...))
+}
+
+// readEXIF returns the ASCII IFD0 and Exif IFD tags of a JPEG rewritten by
+// rewriteJPEGEXIF, plus the bytes from SOS onward.
+func readEXIF(t *testing.T, jpeg []byte) (map[uint16]string, []byte) {
+	t.Helper()
+	pos := 2
+	var tiff []byte
+	for jpeg[pos+1] != 0xDA {
+		n := int(binary.BigEndian.Uint16(jpeg[pos+2:]))
+		if body := jpeg[pos+4 : pos+2+n]; jpeg[pos+1] == 0xE1 && bytes.HasPrefix(body, exifHeader) {
+			tiff = body[len(exifHeader):]
+		}
+		pos += 2 + n
+	}
+	if tiff == nil {
+		t.Fatal("no EXIF segment")
+	}
+	bo := binary.ByteOrder(binary.BigEndian)
+	if tiff[0] == 'I' {
+		bo = binary.LittleEndian
+	}
+	tags := map[uint16]string{}
+	collect := func(entries []ifdEntry) {
+		for _, e := range entries {
+			if e.typ == 2 {
+				v, err := entryString(tiff, bo, e)
+				if err != nil {
+					t.Fatalf("tag 0x%04X: %v", e.tag, err)
+				}
+				tags[e.tag] = v
+			}
+		}
+	}
+	ifd0, _, err := readIFD(tiff, bo, bo.Uint32(tiff[4:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	collect(ifd0)
+	if ptr, ok := findEntry(ifd0, tagExifIFD); ok {
+		exif, _, err := readIFD(tiff, bo, bo.Uint32(ptr.value[:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		collect(exif)
+	}
+	return tags, jpeg[pos:]
+}
+
+func TestRewriteJPEGEXIF(t *testing.T) {
+	taken := time.Date(2022, 8, 9, 10, 11, 12, 0, time.UTC)
+	full := exifUpdate{description: "Sunset over the bay", artist: "Ada Lovelace", taken: taken}
+
+	tests := []struct {
+		name   string
+		in     []byte
+		update exifUpdate
+		want   map[uint16]string
+	}{
+		{
+			name:   "no EXIF creates one after JFIF",
+			in:     testJPEG(jfifSegment),
+			update: full,
+			want: map[uint16]string{
+				tagImageDescription:   "Sunset over the bay",
+				tagArtist:             "Ada Lovelace",
+				tagDateTimeOriginal:   "2022:08:09 10:11:12",
+				tagOffsetTimeOriginal: "+00:00",
+			},
+		},
+		{
+			name:   "camera date is kept",
+			in:     testJPEG(cameraEXIF("2021:01:02 03:04:05")),
+			update: full,
+			want: map[uint16]string{
+				0x010F:              "Apple Inc.",
+				tagImageDescription: "Sunset over the bay",
+				tagArtist:           "Ada Lovelace",
+				tagDateTimeOriginal: "2021:01:02 03:04:05",
+			},
+		},
+		{
+			name:   "blank camera date is filled",
+			in:     testJPEG(jfifSegment, cameraEXIF("    :  :     :  :  ")),
+			update: exifUpdate{taken: taken},
+			want: map[uint16]string{
+				0x010F:                "Apple Inc.",
+				tagDateTimeOriginal:   "2022:08:09 10:11:12",
+				tagOffsetTimeOriginal: "+00:00",
+			},
+		},
+		{
+			name:   "short values are stored inline",
+			in:     testJPEG(),
+			update: exifUpdate{artist: "Al"},
+			want:   map[uint16]string{tagArtist: "Al"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := rewriteJPEGEXIF(tt.in, tt.update)
+			if err != nil {
+				t.Fatalf("rewriteJPEGEXIF: %v", err)
+			}
+			tags, tail := readEXIF(t, out)
+			for tag, want := range tt.want {
+				if tags[tag] != want {
+					t.Errorf("tag 0x%04X = %q, want %q", tag, tags[tag], want)
+				}
+			}
+			if len(tags) != len(tt.want) {
+				t.Errorf("tags = %q, want %q", tags, tt.want)
+			}
+			if !bytes.Equal(tail, scanData) {
+				t.Errorf("scan data changed")
+			}
+			if !bytes.HasPrefix(out, []byte{0xFF, 0xD8}) {
+				t.Errorf("output does not start with SOI")
+			}
+		})
+	}
+}
+
+func TestRewriteJPEGEXIF_DecodesIdentically(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 16; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 16), uint8(y * 16), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	out, err := rewriteJPEGEXIF(buf.Bytes(), exifUpdate{description: "Sunset", taken: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := jpeg.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("rewritten JPEG does not decode: %v", err)
+	}
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 16; y++ {
+			if before.At(x, y) != after.At(x, y) {
+				t.Fatalf("pixel (%d,%d) changed", x, y)
+			}
+		}
+	}
+}
+
+func TestRewriteJPEGEXIF_KeepsJFIFFirst(t *testing.T) {
+	out, err := rewriteJPEGEXIF(testJPEG(jfifSegment), exifUpdate{artist: "Ada"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out[2:2+len(jfifSegment)], jfifSegment) {
+		t.Errorf("JFIF APP0 is no longer the first segment")
+	}
+}
+
+func TestRewriteJPEGEXIF_NoChange(t *testing.T) {
+	in := testJPEG(cameraEXIF("2021:01:02 03:04:05"))
+	once, err := rewriteJPEGEXIF(in, exifUpdate{artist: "Ada Lovelace", taken: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	twice, err := rewriteJPEGEXIF(once, exifUpdate{artist: "Ada Lovelace", taken: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if twice != nil {
+		t.Errorf("rewriting unchanged tags produced new output")
+	}
+}
+
+func TestRewriteJPEGEXIF_Unsafe(t *testing.T) {
+	badIFD := segment(0xE1, []byte("Exif\x00\x00II*\x00\xff\xff\x00\x00"))
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"not a JPEG", []byte("\x89PNG\r\n\x1a\n")},
+		{"segment overruns file", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x10, 0x00, 0x00}},
+		{"garbage between segments", append([]byte{0xFF, 0xD8, 0x00}, scanData...)},
+		{"IFD offset out of range", testJPEG(badIFD)},
+		{"bad byte order", testJPEG(segment(0xE1, []byte("Exif\x00\x00XX*\x00\x08\x00\x00\x00")))},
+		{"two EXIF segments", testJPEG(cameraEXIF("2021:01:02 03:04:05"), cameraEXIF("2021:01:02 03:04:05"))},
+		{"block would exceed 64 KiB", testJPEG(cameraEXIF("2021:01:02 03:04:05"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := exifUpdate{artist: "Ada"}
+			if tt.name == "block would exceed 64 KiB" {
+				u.description = string(bytes.Repeat([]byte("x"), 0xFFFF))
+			}
+			if _, err := rewriteJPEGEXIF(tt.in, u); !errors.Is(err, ErrEXIFUnsafe) {
+				t.Errorf("err = %v, want ErrEXIFUnsafe", err)
+			}
+		})
+	}
+}
+
+func TestEXIFWriter_Process(t *testing.T) {
+	dir := t.TempDir()
+	captured := time.Date(2022, 8, 9, 10, 11, 12, 0, time.UTC)
+	write := func(name string, data []byte) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, captured, captured); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	photo := &Image{
+		PhotoGUID:           "g1",
+		Caption:             strPtr("Sunset"),
+		DateCreated:         strPtr("2022-08-09T10:11:12Z"),
+		ContributorFullName: strPtr("Ada Lovelace"),
+	}
+
+	t.Run("rewrites JPEG and keeps mtime", func(t *testing.T) {
+		p := write("a.jpg", testJPEG(jfifSegment))
+		if err := (EXIFWriter{}).Process(context.Background(), SavedPhoto{Path: p, Photo: photo}); err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+		data, _ := os.ReadFile(p)
+		tags, tail := readEXIF(t, data)
+		if tags[tagImageDescription] != "Sunset" || tags[tagArtist] != "Ada Lovelace" {
+			t.Errorf("tags = %q", tags)
+		}
+		if !bytes.Equal(tail, scanData) {
+			t.Errorf("scan data changed")
+		}
+		info, _ := os.Stat(p)
+		if !info.ModTime().Equal(captured) {
+			t.Errorf("mtime = %v, want %v", info.ModTime(), captured)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+			t.Errorf("temp files left behind: %v", entries)
+		}
+	})
+
+	t.Run("skips non-JPEG", func(t *testing.T) {
+		in := []byte("\x00\x00\x00\x18ftypmp42")
+		p := write("b.mp4", in)
+		if err := (EXIFWriter{}).Process(context.Background(), SavedPhoto{Path: p, Photo: photo}); err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+		if data, _ := os.ReadFile(p); !bytes.Equal(data, in) {
+			t.Errorf("non-JPEG was modified")
+		}
+		os.Remove(p)
+	})
+
+	t.Run("leaves unsafe JPEG unchanged", func(t *testing.T) {
+		in := testJPEG(segment(0xE1, []byte("Exif\x00\x00II*\x00\xff\xff\x00\x00")))
+		p := write("c.jpg", in)
+		err := (EXIFWriter{}).Process(context.Background(), SavedPhoto{Path: p, Photo: photo})
+		if !errors.Is(err, ErrEXIFUnsafe) {
+			t.Errorf("err = %v, want ErrEXIFUnsafe", err)
+		}
+		if data, _ := os.ReadFile(p); !bytes.Equal(data, in) {
+			t.Errorf("unsafe JPEG was modified")
+		}
+	})
+}
+
+func TestClient_DownloadAlbum_BackfillsEXIF(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, _ = w.Write(testJPEG(jfifSegment))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	resp := albumOf(srv, 1)
+	resp.Photos[0].Caption = strPtr("Sunset")
+	c := NewClient(WithDownloadHTTPClient(srv.Client()))
+	run := func(post ...PostProcessor) *DownloadReport {
+		t.Helper()
+		report, err := c.DownloadAlbum(context.Background(), resp, DownloadOptions{
+			OutputDir: dir, UseManifest: true, PostProcessors: post,
+		})
+		if err != nil {
+			t.Fatalf("DownloadAlbum() error = %v", err)
+		}
+		return report
+	}
+
+	run()
+	hits.Store(0)
+	for i := 0; i < 2; i++ {
+		report := run(EXIFWriter{})
+		if report.Unchanged != 1 || report.Results[0].PostErr != nil || hits.Load() != 0 {
+			t.Fatalf("run %d: report = %+v, %d requests; want 1 unchanged, no downloads", i, report, hits.Load())
+		}
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "1_g0_Sunset.jpg"))
+	if tags, _ := readEXIF(t, data); tags[tagImageDescription] != "Sunset" {
+		t.Errorf("ImageDescription = %q, want backfilled caption", tags[tagImageDescription])
+	}
+}
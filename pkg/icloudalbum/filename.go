@@ -0,0 +1,260 @@
+// ABOUTME: Filename profiles (POSIX, Windows, macOS, portable) for cleaning path components
+// ABOUTME: Resolves name collisions with other photos and existing files using numbered suffixes
+package icloudalbum
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// FilenameProfile selects the filesystem rules downloaded file names must satisfy.
+type FilenameProfile string
+
+const (
+	// ProfilePortable produces names valid on every supported system (default).
+	ProfilePortable FilenameProfile = "portable"
+	// ProfilePOSIX only forbids "/" and control characters; names are case-sensitive.
+	ProfilePOSIX FilenameProfile = "posix"
+	// ProfileWindows forbids <>:"\|?*, reserved device names such as CON and
+	// COM1, and trailing dots or spaces; names are case-insensitive.
+	ProfileWindows FilenameProfile = "windows"
+	// ProfileMacOS forbids ":"; names are case-insensitive.
+	ProfileMacOS FilenameProfile = "macos"
+)
+
+// maxNameBytes caps each path component below the common 255-byte limit,
+// leaving room for the ".partial.json" suffix used while downloading.
+const maxNameBytes = 255 - len(".partial.json")
+
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// WithFilenameProfile sets the rules used to clean downloaded file names
+// (default ProfilePortable).
+func WithFilenameProfile(p FilenameProfile) Option {
+	return func(c *Client) { c.profile = p }
+}
+
+// ParseFilenameProfile parses "portable", "posix", "windows" or "macos".
+func ParseFilenameProfile(s string) (FilenameProfile, error) {
+	switch p := FilenameProfile(strings.ToLower(s)); p {
+	case ProfilePortable, ProfilePOSIX, ProfileWindows, ProfileMacOS:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown filename profile %q", s)
+}
+
+// CleanName makes one path component valid under p. It normalizes to NFC,
+// replaces forbidden characters with "_", avoids reserved names and trailing
+// dots or spaces where they are not allowed, and truncates to the byte limit
+// at a character boundary, keeping the extension.
+func (p FilenameProfile) CleanName(name string) string {
+	name = norm.NFC.String(name)
+	name = strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || p.forbidden(r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = truncateName(name, maxNameBytes)
+	if p.windowsRules() {
+		name = strings.TrimRight(name, ". ")
+		stem, rest, _ := strings.Cut(name, ".")
+		if windowsReserved[strings.ToUpper(strings.TrimRight(stem, " "))] {
+			name = stem + "_"
+			if rest != "" {
+				name += "." + rest
+			}
+		}
+	}
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+func (p FilenameProfile) forbidden(r rune) bool {
+	if r < 32 || r == 127 || r == '/' {
+		return true
+	}
+	switch p {
+	case ProfilePOSIX:
+		return false
+	case ProfileMacOS:
+		return r == ':'
+	default:
+		return strings.ContainsRune(`<>:"\|?*`, r)
+	}
+}
+
+func (p FilenameProfile) windowsRules() bool {
+	return p != ProfilePOSIX && p != ProfileMacOS
+}
+
+func (p FilenameProfile) caseInsensitive() bool {
+	return p != ProfilePOSIX
+}
+
+// cleanPath applies CleanName to every component of a slash-separated relative path.
+func (p FilenameProfile) cleanPath(rel string) string {
+	segs := strings.Split(rel, "/")
+	for i, s := range segs {
+		segs[i] = p.CleanName(s)
+	}
+	return filepath.Join(segs...)
+}
+
+// truncateName shortens name to at most limit bytes without splitting a
+// UTF-8 sequence, preserving a short extension.
+func truncateName(name string, limit int) string {
+	if len(name) <= limit {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > 16 {
+		ext = ""
+	}
+	stem := name[:len(name)-len(ext)]
+	cut := limit - len(ext)
+	for cut > 0 && !utf8.RuneStart(stem[cut]) {
+		cut--
+	}
+	return stem[:cut] + ext
+}
+
+// nameReserver hands out unique file stems (paths without extension) within
+// one DownloadAlbum run. A stem claimed by another photo, earlier in the run or
+// in the manifest, or used by a file on disk that is not provably this photo's,
+// gets the first free "_2", "_3", ... suffix. Comparisons follow the profile's
+// case sensitivity.
+type nameReserver struct {
+	profile FilenameProfile
+	mu      sync.Mutex
+	owners  map[string]string              // stem key -> PhotoGUID
+	listed  map[string]map[string][]string // directory -> stem key -> files on disk
+}
+
+func newNameReserver(p FilenameProfile) *nameReserver {
+	return &nameReserver{profile: p, owners: map[string]string{}, listed: map[string]map[string][]string{}}
+}
+
+// claim records that stem belongs to guid, e.g. because the manifest says so.
+func (r *nameReserver) claim(guid, stem string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.owners[r.key(stem)] = guid
+}
+
+// reserve returns stem, or stem with a numbered suffix, such that no other
+// photo uses it and every file already on disk under that stem is one own
+// accepts as guid's earlier download. A nil own treats every file as foreign.
+func (r *nameReserver) reserve(guid, stem string, own func(path string) bool) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for n := 1; ; n++ {
+		cand := suffixedStem(stem, n)
+		key := r.key(cand)
+		if owner, ok := r.owners[key]; ok {
+			if owner == guid {
+				return cand
+			}
+			continue
+		}
+		if !r.ownsFilesOf(cand, own) {
+			continue
+		}
+		r.owners[key] = guid
+		return cand
+	}
+}
+
+func (r *nameReserver) key(stem string) string {
+	k := norm.NFC.String(filepath.Clean(stem))
+	if r.profile.caseInsensitive() {
+		k = strings.ToLower(k)
+	}
+	return k
+}
+
+// ownsFilesOf reports whether every file on disk with this stem, whatever its
+// extension, passes own. Download leftovers (.partial files, the manifest)
+// and XMP sidecars named after the photo do not count.
+func (r *nameReserver) ownsFilesOf(stem string, own func(path string) bool) bool {
+	dir := filepath.Dir(stem)
+	stems, ok := r.listed[dir]
+	if !ok {
+		stems = map[string][]string{}
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			name := e.Name()
+			if name == ManifestFileName || strings.HasSuffix(name, ".partial") || strings.HasSuffix(name, ".partial.json") ||
+				strings.EqualFold(filepath.Ext(name), ".xmp") {
+				continue
+			}
+			k := r.key(filepath.Join(dir, strings.TrimSuffix(name, filepath.Ext(name))))
+			stems[k] = append(stems[k], filepath.Join(dir, name))
+		}
+		r.listed[dir] = stems
+	}
+	for _, path := range stems[r.key(stem)] {
+		if own == nil || !own(path) {
+			return false
+		}
+	}
+	return true
+}
+
+// suffixExtRoom is kept free in suffixed names for the extension added at
+// download time; truncateName keeps extensions up to this length.
+const suffixExtRoom = 16
+
+// suffixedStem returns stem for n == 1 and stem plus "_n" otherwise, cutting
+// the last path component so the suffixed name and its extension still fit in
+// maxNameBytes.
+func suffixedStem(stem string, n int) string {
+	if n == 1 {
+		return stem
+	}
+	suffix := fmt.Sprintf("_%d", n)
+	dir, base := filepath.Split(stem)
+	if limit := maxNameBytes - suffixExtRoom - len(suffix); len(base) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(base[cut]) {
+			cut--
+		}
+		base = base[:cut]
+	}
+	return dir + base + suffix
+}
+
+// withSuffix makes name produce unique, as returned by reserve for stem, in
+// place of stem.
+func withSuffix(name namer, stem, unique string) namer {
+	if unique == stem {
+		return name
+	}
+	return func(ext string) (string, error) {
+		p, err := name(ext)
+		if err != nil {
+			return "", err
+		}
+		if strings.HasSuffix(p, ext) {
+			return unique + ext, nil
+		}
+		// The template puts text after the extension; suffix the whole name.
+		suffix := unique[strings.LastIndex(unique, "_"):]
+		dir, base := filepath.Split(p)
+		return dir + truncateName(base, maxNameBytes-len(suffix)) + suffix, nil
+	}
+}
@@ -0,0 +1,255 @@
+// ABOUTME: Test suite for filename profiles and collision handling
+// ABOUTME: Covers reserved names, Unicode normalization, byte limits and numbered suffixes
+package icloudalbum
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestFilenameProfile_CleanName(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile FilenameProfile
+		in      string
+		want    string
+	}{
+		{"windows reserved name", ProfileWindows, "CON.jpg", "CON_.jpg"},
+		{"windows reserved, lower case", ProfileWindows, "com1", "com1_"},
+		{"portable reserved name", ProfilePortable, "nul.tar.gz", "nul_.tar.gz"},
+		{"posix allows reserved name", ProfilePOSIX, "CON.jpg", "CON.jpg"},
+		{"windows trailing dots", ProfileWindows, "photo. . ", "photo"},
+		{"windows forbidden chars", ProfileWindows, `a<b>c:d"e|f?g*h\i.jpg`, "a_b_c_d_e_f_g_h_i.jpg"},
+		{"macos colon", ProfileMacOS, "12:30.jpg", "12_30.jpg"},
+		{"macos keeps question mark", ProfileMacOS, "why?.jpg", "why?.jpg"},
+		{"posix keeps colon", ProfilePOSIX, "12:30.jpg", "12:30.jpg"},
+		{"control chars", ProfilePOSIX, "a\x00b\nc", "a_b_c"},
+		{"NFD normalized to NFC", ProfilePOSIX, "Cafe\u0301.jpg", "Caf\u00e9.jpg"},
+		{"empty", ProfilePortable, "", "_"},
+		{"dot dot", ProfilePOSIX, "..", "_"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.profile.CleanName(tt.in); got != tt.want {
+				t.Errorf("%s.CleanName(%q) = %q, want %q", tt.profile, tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilenameProfile_CleanNameByteLimit(t *testing.T) {
+	in := strings.Repeat("\U0001F600", 100) + ".jpg" // 404 bytes, 104 runes
+	got := ProfilePortable.CleanName(in)
+	if len(got) > maxNameBytes || !utf8.ValidString(got) || !strings.HasSuffix(got, ".jpg") {
+		t.Errorf("CleanName(emoji) = %d bytes, valid %v; want <= %d bytes ending in .jpg", len(got), utf8.ValidString(got), maxNameBytes)
+	}
+}
+
+func TestSanitize_ByteLimit(t *testing.T) {
+	got := sanitize(strings.Repeat("\U0001F600", 100))
+	if len(got) > 210 || !utf8.ValidString(got) || !strings.HasSuffix(got, "_truncated") {
+		t.Errorf("sanitize(emoji) = %d bytes, valid %v; want <= 210 bytes ending in _truncated", len(got), utf8.ValidString(got))
+	}
+}
+
+func TestParseFilenameProfile(t *testing.T) {
+	for _, s := range []string{"portable", "POSIX", "windows", "macos"} {
+		if _, err := ParseFilenameProfile(s); err != nil {
+			t.Errorf("ParseFilenameProfile(%q) error = %v", s, err)
+		}
+	}
+	if _, err := ParseFilenameProfile("amiga"); err == nil {
+		t.Error("ParseFilenameProfile(amiga) should fail")
+	}
+}
+
+func TestNameReserver(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"Beach.jpg", "Sunset.partial", "Sunset.partial.json", "Dawn.xmp"} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte("abc"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	at := func(stem string) string { return filepath.Join(dir, stem) }
+	sizeIs := func(n int64) func(string) bool {
+		return func(path string) bool {
+			info, err := os.Stat(path)
+			return err == nil && info.Size() == n
+		}
+	}
+
+	tests := []struct {
+		name string
+		stem string
+		own  func(string) bool
+		want string
+	}{
+		{"unrelated file on disk", "Beach", sizeIs(99), "Beach_2"},
+		{"unknown size treats file as unrelated", "Beach", nil, "Beach_2"},
+		{"file matches the photo", "Beach", sizeIs(3), "Beach"},
+		{"case differs on posix", "beach", nil, "beach"},
+		{"partial leftovers ignored", "Sunset", nil, "Sunset"},
+		{"xmp sidecar ignored", "Dawn", nil, "Dawn"},
+	}
+	for _, tt := range tests {
+		r := newNameReserver(ProfilePOSIX)
+		if got := r.reserve("g1", at(tt.stem), tt.own); got != at(tt.want) {
+			t.Errorf("%s: reserve(%q) = %q, want %q", tt.name, tt.stem, filepath.Base(got), tt.want)
+		}
+	}
+
+	r := newNameReserver(ProfilePOSIX)
+	r.reserve("g1", at("Noon"), nil)
+	if got := r.reserve("g1", at("Noon"), nil); got != at("Noon") {
+		t.Errorf("same photo again = %q, want Noon", filepath.Base(got))
+	}
+	if got := r.reserve("g2", at("Noon"), nil); got != at("Noon_2") {
+		t.Errorf("used by another photo = %q, want Noon_2", filepath.Base(got))
+	}
+
+	ci := newNameReserver(ProfileMacOS)
+	if got := ci.reserve("g1", at("BEACH"), sizeIs(3)); got != at("BEACH") {
+		t.Errorf("case-insensitive reserve(BEACH) = %q, want BEACH", filepath.Base(got))
+	}
+	if got := ci.reserve("g2", at("beach"), sizeIs(3)); got != at("beach_2") {
+		t.Errorf("case-insensitive reserve(beach) = %q, want beach_2", filepath.Base(got))
+	}
+	ci.claim("g9", at("Dawn"))
+	if got := ci.reserve("g2", at("dawn"), nil); got != at("dawn_2") {
+		t.Errorf("reserve(dawn) after claim = %q, want dawn_2", filepath.Base(got))
+	}
+}
+
+func TestSuffixedStem_ByteLimit(t *testing.T) {
+	long := filepath.Join("out", strings.Repeat("é", maxNameBytes/2))
+	for _, n := range []int{2, 10, 100} {
+		got := filepath.Base(suffixedStem(long, n))
+		if len(got)+len(".jpeg.partial.json") > 255 || !utf8.ValidString(got) || !strings.HasSuffix(got, fmt.Sprintf("_%d", n)) {
+			t.Errorf("suffixedStem(n=%d) = %d bytes, valid %v", n, len(got), utf8.ValidString(got))
+		}
+	}
+	if got := suffixedStem("out/short", 2); got != "out/short_2" {
+		t.Errorf("suffixedStem(short) = %q", got)
+	}
+}
+
+// servedJPEG is what collisionServer serves, and its size.
+var servedJPEG = []byte{0xFF, 0xD8, 0xFF}
+
+func collisionServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(servedJPEG)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// sizedAlbumOf is albumOf with each derivative's FileSize set to what the
+// server sends, as Apple reports it.
+func sizedAlbumOf(srv *httptest.Server, n int) *ICloudResponse {
+	resp := albumOf(srv, n)
+	size := Uint64OrString(len(servedJPEG))
+	for i := range resp.Photos {
+		d := resp.Photos[i].Derivatives["original"]
+		d.FileSize = &size
+		resp.Photos[i].Derivatives["original"] = d
+	}
+	return resp
+}
+
+func TestClient_DownloadAlbum_Collisions(t *testing.T) {
+	for _, useManifest := range []bool{false, true} {
+		t.Run(fmt.Sprintf("manifest=%v", useManifest), func(t *testing.T) {
+			srv := collisionServer(t)
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "Beach.jpg"), []byte("user's own file"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			resp := sizedAlbumOf(srv, 3)
+			for i, c := range []string{"Beach", "beach", "Beach"} {
+				resp.Photos[i].Caption = strPtr(c)
+			}
+
+			c := NewClient(WithDownloadHTTPClient(srv.Client()))
+			report, err := c.DownloadAlbum(context.Background(), resp, DownloadOptions{
+				OutputDir:    dir,
+				Concurrency:  3,
+				PathTemplate: MustParsePathTemplate("{caption}{ext}"),
+				UseManifest:  useManifest,
+			})
+			if err != nil || report.Downloaded != 3 {
+				t.Fatalf("DownloadAlbum() = %+v, %v", report, err)
+			}
+			for i, want := range []string{"Beach_2.jpg", "beach_3.jpg", "Beach_4.jpg"} {
+				if got := filepath.Base(report.Results[i].Path); got != want {
+					t.Errorf("Results[%d] saved as %q, want %q", i, got, want)
+				}
+			}
+			if b, _ := os.ReadFile(filepath.Join(dir, "Beach.jpg")); string(b) != "user's own file" {
+				t.Error("existing Beach.jpg was overwritten")
+			}
+		})
+	}
+}
+
+func TestClient_DownloadAlbum_CollisionsAtByteLimit(t *testing.T) {
+	srv := collisionServer(t)
+	dir := t.TempDir()
+	resp := sizedAlbumOf(srv, 2)
+	long := strings.Repeat("x", 300)
+	resp.Photos[0].Caption = strPtr(long)
+	resp.Photos[1].Caption = strPtr(long)
+
+	c := NewClient(WithDownloadHTTPClient(srv.Client()))
+	report, err := c.DownloadAlbum(context.Background(), resp, DownloadOptions{
+		OutputDir:    dir,
+		PathTemplate: MustParsePathTemplate("{caption}{ext}"),
+	})
+	if err != nil || report.Downloaded != 2 {
+		t.Fatalf("DownloadAlbum() = %+v, %v", report, err)
+	}
+	first, second := filepath.Base(report.Results[0].Path), filepath.Base(report.Results[1].Path)
+	if first == second || !strings.HasSuffix(second, "_2.jpg") {
+		t.Errorf("saved as %q and %q, want distinct names with _2 on the second", first, second)
+	}
+	for _, name := range []string{first, second} {
+		if len(name) > maxNameBytes {
+			t.Errorf("%q is %d bytes, want <= %d", name, len(name), maxNameBytes)
+		}
+	}
+}
+
+func TestClient_DownloadAlbum_RerunWithoutManifest(t *testing.T) {
+	srv := collisionServer(t)
+	dir := t.TempDir()
+	resp := sizedAlbumOf(srv, 3)
+	resp.Photos[1].Caption = strPtr("Beach")
+	resp.Photos[2].Caption = strPtr("Beach")
+
+	c := NewClient(WithDownloadHTTPClient(srv.Client()))
+	for run := 1; run <= 3; run++ {
+		report, err := c.DownloadAlbum(context.Background(), resp, DownloadOptions{
+			OutputDir:    dir,
+			PathTemplate: MustParsePathTemplate("{caption|guid}{ext}"),
+		})
+		if err != nil || report.Downloaded != 3 {
+			t.Fatalf("run %d: DownloadAlbum() = %+v, %v", run, report, err)
+		}
+		for i, want := range []string{"g0.jpg", "Beach.jpg", "Beach_2.jpg"} {
+			if got := filepath.Base(report.Results[i].Path); got != want {
+				t.Errorf("run %d: Results[%d] saved as %q, want %q", run, i, got, want)
+			}
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 3 {
+		t.Errorf("output dir has %d entries after 3 runs, want 3", len(entries))
+	}
+}
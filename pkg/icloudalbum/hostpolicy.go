@@ -0,0 +1,69 @@
+// ABOUTME: Allowlist policy for server-supplied hosts (330 redirects and asset URLs)
+// ABOUTME: Rejects hosts outside Apple's domains and anything carrying ports, paths or userinfo
+package icloudalbum
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DefaultAllowedHosts covers iCloud's sharedstreams partitions and its asset CDN.
+var DefaultAllowedHosts = []string{
+	"*.icloud.com",
+	"*.icloud.com.cn",
+	"*.icloud-content.com",
+	"*.icloud-content.com.cn",
+}
+
+// ErrHostNotAllowed matches every *HostNotAllowedError.
+var ErrHostNotAllowed = errors.New("host not allowed")
+
+// HostNotAllowedError reports a server-supplied host that failed the allowlist.
+type HostNotAllowedError struct {
+	Host   string
+	Source string // "redirect" or "asset url"
+	Reason string
+}
+
+func (e *HostNotAllowedError) Error() string {
+	return fmt.Sprintf("%s host %q not allowed: %s", e.Source, e.Host, e.Reason)
+}
+
+// Is makes errors.Is(err, ErrHostNotAllowed) true.
+func (e *HostNotAllowedError) Is(target error) bool {
+	return target == ErrHostNotAllowed
+}
+
+// WithAllowedHosts replaces the allowlist for server-supplied hosts. Patterns are
+// exact host names or "*.domain", which matches any subdomain of domain.
+func WithAllowedHosts(patterns ...string) Option {
+	return func(c *Client) {
+		c.allowedHosts = append([]string(nil), patterns...)
+	}
+}
+
+// checkHost validates a bare host name taken from an Apple response.
+func (c *Client) checkHost(host, source string) error {
+	reject := func(reason string) error {
+		return &HostNotAllowedError{Host: host, Source: source, Reason: reason}
+	}
+	if host == "" {
+		return reject("empty host")
+	}
+	if i := strings.IndexAny(host, ":/@?#\\ \t\r\n%"); i >= 0 {
+		return reject(fmt.Sprintf("contains %q", host[i]))
+	}
+	h := strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, p := range c.allowedHosts {
+		p = strings.ToLower(p)
+		if suffix, ok := strings.CutPrefix(p, "*."); ok {
+			if strings.HasSuffix(h, "."+suffix) {
+				return nil
+			}
+		} else if h == p {
+			return nil
+		}
+	}
+	return reject("not in allowlist")
+}
@@ -0,0 +1,93 @@
+// ABOUTME: Test suite for the server-supplied host allowlist
+// ABOUTME: Covers pattern matching, malformed hosts and enforcement on redirects and asset URLs
+package icloudalbum
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestClient_CheckHost(t *testing.T) {
+	c := NewClient()
+	tests := []struct {
+		host    string
+		allowed bool
+	}{
+		{"p42-sharedstreams.icloud.com", true},
+		{"P42-SHAREDSTREAMS.ICLOUD.COM", true},
+		{"cvws.icloud-content.com", true},
+		{"cvws.icloud-content.com.", true},
+		{"icloud.com", false},
+		{"evil.com", false},
+		{"icloud.com.evil.com", false},
+		{"evilicloud.com", false},
+		{"p42-sharedstreams.icloud.com:8443", false},
+		{"p42-sharedstreams.icloud.com/path", false},
+		{"user@p42-sharedstreams.icloud.com", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			err := c.checkHost(tt.host, "redirect")
+			if (err == nil) != tt.allowed {
+				t.Errorf("checkHost(%q) error = %v, want allowed %v", tt.host, err, tt.allowed)
+			}
+			if err != nil && !errors.Is(err, ErrHostNotAllowed) {
+				t.Errorf("checkHost(%q) error should match ErrHostNotAllowed", tt.host)
+			}
+		})
+	}
+}
+
+func TestClient_CheckHostCustomAllowlist(t *testing.T) {
+	c := NewClient(WithAllowedHosts("photos.example.net", "*.cdn.example.net"))
+	if err := c.checkHost("photos.example.net", "redirect"); err != nil {
+		t.Errorf("exact pattern should match: %v", err)
+	}
+	if err := c.checkHost("a.cdn.example.net", "asset url"); err != nil {
+		t.Errorf("wildcard pattern should match: %v", err)
+	}
+	if err := c.checkHost("p01-sharedstreams.icloud.com", "redirect"); err == nil {
+		t.Error("defaults should be replaced by WithAllowedHosts")
+	}
+}
+
+func TestClient_FetchRejectsForeignRedirect(t *testing.T) {
+	srv := newFakeAlbumServer(t, fakeAlbum{
+		webstream: func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(330)
+			writeJSON(w, map[string]string{"X-Apple-MMe-Host": "attacker.example.com"})
+		},
+	})
+	c := NewClient(WithBaseURL(srv.URL))
+
+	_, err := c.Fetch(context.Background(), "B0aGWZuqDGKjsR")
+	var he *HostNotAllowedError
+	if !errors.As(err, &he) || he.Host != "attacker.example.com" || he.Source != "redirect" {
+		t.Fatalf("Fetch() error = %v, want *HostNotAllowedError for the redirect", err)
+	}
+}
+
+func TestClient_AssetURLsRejectsForeignHosts(t *testing.T) {
+	srv := newFakeAlbumServer(t, fakeAlbum{
+		webasseturls: func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, map[string]any{"items": map[string]any{
+				"good":  map[string]any{"url_location": "cvws.icloud-content.com", "url_path": "/B/x.jpg"},
+				"bad":   map[string]any{"url_location": "evil.example.com", "url_path": "/x.jpg"},
+				"trick": map[string]any{"url_location": "cvws.icloud-content.com", "url_path": "@evil.example.com/x.jpg"},
+			}})
+		},
+	})
+	c := NewClient()
+
+	urls, err := c.AssetURLs(context.Background(), srv.URL+"/B0aGWZuqDGKjsR/sharedstreams/", []string{"good", "bad", "trick"})
+	if !errors.Is(err, ErrHostNotAllowed) {
+		t.Errorf("AssetURLs() error = %v, want ErrHostNotAllowed", err)
+	}
+	if len(urls) != 1 || urls["good"] != "https://cvws.icloud-content.com/B/x.jpg" {
+		t.Errorf("AssetURLs() = %v, want only the allowed URL", urls)
+	}
+}
@@ -3,6 +3,7 @@
 package icloudalbum
 
 import (
+	"context"
 	"net/http"
 	"time"
 )
@@ -12,46 +13,94 @@ var defaultClient = &http.Client{
 }
 
 // GetICloudPhotos orchestrates:
-// 1) base URL from token
-// 2) 330 redirect handling
-// 3) webstream metadata+photos
+// 1) base URL from token (or a cached redirect target)
+// 2) webstream metadata+photos, following Apple's 330 redirect
+// 3) parse the webstream response
 // 4) webasseturls URLs
 // 5) enrichment of derivatives with URLs
 func GetICloudPhotos(token string) (*ICloudResponse, error) {
 	return GetICloudPhotosWithClient(token, defaultClient)
 }
 
+// GetICloudPhotosContext is like GetICloudPhotos but honors ctx for cancellation.
+func GetICloudPhotosContext(ctx context.Context, token string) (*ICloudResponse, error) {
+	return GetICloudPhotosWithClientContext(ctx, token, defaultClient)
+}
+
 // GetICloudPhotosWithClient allows using a custom HTTP client for advanced use cases.
 func GetICloudPhotosWithClient(token string, client *http.Client) (*ICloudResponse, error) {
+	return GetICloudPhotosWithClientContext(context.Background(), token, client)
+}
 
-	base, err := GetBaseURL(token)
-	if err != nil {
-		return nil, err
-	}
-	redirected, err := GetRedirectedBaseURL(client, base, token)
-	if err != nil {
-		return nil, err
+// GetICloudPhotosWithClientContext is like GetICloudPhotosWithClient but honors ctx.
+func GetICloudPhotosWithClientContext(ctx context.Context, token string, client *http.Client) (*ICloudResponse, error) {
+	return NewClient(WithHTTPClient(client), withRedirectCache(legacyRedirects)).Fetch(ctx, token)
+}
+
+// Fetch runs the full orchestration (base URL, redirect, webstream, asset URLs,
+// enrichment) for token using the client's configuration.
+func (c *Client) Fetch(ctx context.Context, token string) (*ICloudResponse, error) {
+	return c.FetchSince(ctx, token, "")
+}
+
+// FetchSince is like Fetch but sends ctag (usually Metadata.StreamCTag from a previous
+// fetch) so only photos added or changed since then are returned. If nothing changed,
+// the response has Unchanged set and no asset URL request is made. An empty ctag
+// fetches the whole album.
+func (c *Client) FetchSince(ctx context.Context, token, ctag string) (*ICloudResponse, error) {
+	ctx = contextWithLogger(ctx, c.logger.With("token_hash", tokenHash(token)))
+	base, cached := c.redirects.get(token)
+	if !cached {
+		var err error
+		if base, err = c.albumBaseURL(token); err != nil {
+			return nil, err
+		}
 	}
 
-	photos, md, err := getAPIResponse(client, redirected)
+	ws, err := c.getAPIResponse(ctx, token, base, ctag)
+	if err != nil && cached && ctx.Err() == nil {
+		// The partition may have moved since we cached it; start over from the token.
+		c.redirects.forget(token)
+		return c.FetchSince(ctx, token, ctag)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if ws.unchanged {
+		return &ICloudResponse{
+			Metadata:    ws.md,
+			Unchanged:   true,
+			Host:        hostOf(ws.baseURL),
+			Diagnostics: Diagnostics{RedirectChain: ws.chain},
+		}, nil
+	}
+	photos, redirected := ws.photos, ws.baseURL
 
 	guids := make([]string, 0, len(photos))
 	for _, p := range photos {
 		guids = append(guids, p.PhotoGUID)
 	}
-	allURLs, err := GetAssetURLs(client, redirected, guids, nil)
-	if err != nil {
-		// Match Rust behavior: partial degradation is fine (e.g., 400 → empty map)
-		// So we don't fail hard here; we just enrich with whatever we got.
+	diag := Diagnostics{ParseWarnings: ws.warnings, CountMismatch: ws.counts, RedirectChain: ws.chain}
+	allURLs, errs := c.assetURLs(ctx, redirected, guids)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
 	}
+	// Match Rust behavior: partial degradation is fine (e.g., 400 → no URLs)
+	// So we don't fail hard here; we enrich with whatever we got and report it.
+	diag.AssetURLErrors = errs
 
 	EnrichPhotosWithURLs(photos, allURLs)
+	stampURLs(photos, redirected, time.Now())
+	diag.MissingURLs = photosWithoutURLs(photos)
 
-	return &ICloudResponse{
-		Metadata: md,
-		Photos:   photos,
-	}, nil
+	resp := &ICloudResponse{
+		Metadata:    ws.md,
+		Photos:      photos,
+		Host:        hostOf(redirected),
+		Diagnostics: diag,
+	}
+	if kinds := diag.kinds() & c.strict; kinds != 0 {
+		return nil, &DiagnosticsError{Kinds: kinds, Diagnostics: diag}
+	}
+	return resp, nil
 }
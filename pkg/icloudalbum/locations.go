@@ -0,0 +1,96 @@
+// ABOUTME: Lenient decoding of Metadata.Locations into per-photo coordinates
+// ABOUTME: Accepts objects keyed by photo GUID, arrays with photoGuid, or one album-wide location kept apart
+package icloudalbum
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// Location is a geographic position attached to a photo or album.
+type Location struct {
+	Latitude  float64
+	Longitude float64
+	Altitude  *float64 // meters, when known
+}
+
+// Locations maps PhotoGUID to its location. The empty key, if present, holds
+// a location that applies to the whole album.
+type Locations map[string]Location
+
+// ParseLocations decodes the webstream "locations" value. Apple has used
+// several shapes, so it accepts an object keyed by photo GUID, an array of
+// objects carrying a photoGuid, or a single object with coordinates; anything
+// else yields an empty map.
+func ParseLocations(raw json.RawMessage) Locations {
+	locs := Locations{}
+	var one map[string]any
+	if json.Unmarshal(raw, &one) == nil {
+		if loc, ok := locationFrom(one); ok {
+			locs[""] = loc
+			return locs
+		}
+		for guid, v := range one {
+			if m, ok := v.(map[string]any); ok {
+				if loc, ok := locationFrom(m); ok {
+					locs[guid] = loc
+				}
+			}
+		}
+		return locs
+	}
+	var list []map[string]any
+	if json.Unmarshal(raw, &list) == nil {
+		for _, m := range list {
+			guid, _ := m["photoGuid"].(string)
+			if loc, ok := locationFrom(m); ok && guid != "" {
+				locs[guid] = loc
+			}
+		}
+	}
+	return locs
+}
+
+// For returns the location recorded for the photo itself. The album-wide
+// location is not a capture location and is not returned; see Album.
+func (l Locations) For(guid string) (Location, bool) {
+	if guid == "" {
+		return Location{}, false
+	}
+	loc, ok := l[guid]
+	return loc, ok
+}
+
+// Album returns the location that applies to the whole album, if any.
+func (l Locations) Album() (Location, bool) {
+	loc, ok := l[""]
+	return loc, ok
+}
+
+func locationFrom(m map[string]any) (Location, bool) {
+	lat, okLat := firstNumber(m, "latitude", "lat")
+	lon, okLon := firstNumber(m, "longitude", "lon", "lng")
+	if !okLat || !okLon || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return Location{}, false
+	}
+	loc := Location{Latitude: lat, Longitude: lon}
+	if alt, ok := firstNumber(m, "altitude", "alt"); ok {
+		loc.Altitude = &alt
+	}
+	return loc, true
+}
+
+// firstNumber returns the first key holding a number or numeric string.
+func firstNumber(m map[string]any, keys ...string) (float64, bool) {
+	for _, k := range keys {
+		switch v := m[k].(type) {
+		case float64:
+			return v, true
+		case string:
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				return f, true
+			}
+		}
+	}
+	return 0, false
+}
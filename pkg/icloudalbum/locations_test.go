@@ -0,0 +1,53 @@
+// ABOUTME: Test suite for decoding Metadata.Locations
+// ABOUTME: Covers keyed, array and album-wide shapes plus malformed input
+package icloudalbum
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseLocations(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		guid    string
+		wantLat float64
+		wantLon float64
+		wantOK  bool
+	}{
+		{"keyed by guid", `{"g1":{"latitude":37.7749,"longitude":-122.4194}}`, "g1", 37.7749, -122.4194, true},
+		{"string numbers", `{"g1":{"lat":"51.5","lng":"-0.12"}}`, "g1", 51.5, -0.12, true},
+		{"array with photoGuid", `[{"photoGuid":"g1","latitude":1.5,"longitude":2.5}]`, "g1", 1.5, 2.5, true},
+		{"album-wide is not a photo location", `{"latitude":10,"longitude":20}`, "any", 0, 0, false},
+		{"other photo", `{"g1":{"latitude":1,"longitude":2}}`, "g2", 0, 0, false},
+		{"out of range", `{"g1":{"latitude":91,"longitude":2}}`, "g1", 0, 0, false},
+		{"null", `null`, "g1", 0, 0, false},
+		{"empty object", `{}`, "g1", 0, 0, false},
+		{"garbage", `"somewhere"`, "g1", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, ok := ParseLocations(json.RawMessage(tt.raw)).For(tt.guid)
+			if ok != tt.wantOK || ok && (loc.Latitude != tt.wantLat || loc.Longitude != tt.wantLon) {
+				t.Errorf("For(%q) = %+v, %v; want (%v, %v), %v", tt.guid, loc, ok, tt.wantLat, tt.wantLon, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseLocations_Altitude(t *testing.T) {
+	loc, ok := ParseLocations(json.RawMessage(`{"g1":{"latitude":1,"longitude":2,"altitude":-3.5}}`)).For("g1")
+	if !ok || loc.Altitude == nil || *loc.Altitude != -3.5 {
+		t.Errorf("Altitude = %v, want -3.5", loc.Altitude)
+	}
+}
+
+func TestLocations_Album(t *testing.T) {
+	if loc, ok := ParseLocations(json.RawMessage(`{"latitude":10,"longitude":20}`)).Album(); !ok || loc.Latitude != 10 || loc.Longitude != 20 {
+		t.Errorf("Album() = %+v, %v; want (10, 20)", loc, ok)
+	}
+	if _, ok := ParseLocations(json.RawMessage(`{"g1":{"latitude":1,"longitude":2}}`)).Album(); ok {
+		t.Error("Album() should be absent for per-photo locations")
+	}
+}
@@ -0,0 +1,60 @@
+// ABOUTME: Structured logging plumbing built on log/slog with a silent default
+// ABOUTME: Provides the package default logger, request-scoped loggers and token hashing
+package icloudalbum
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"sync/atomic"
+)
+
+// discardHandler drops every record; it is the default so the library stays quiet.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var pkgLogger atomic.Pointer[slog.Logger]
+
+func init() {
+	pkgLogger.Store(slog.New(discardHandler{}))
+}
+
+// SetDefaultLogger sets the logger used by package-level helpers (JSON decoding,
+// MIME mapping) and by Clients created without WithLogger. Nil restores the
+// silent default.
+func SetDefaultLogger(l *slog.Logger) {
+	if l == nil {
+		l = slog.New(discardHandler{})
+	}
+	pkgLogger.Store(l)
+}
+
+func defaultLogger() *slog.Logger {
+	return pkgLogger.Load()
+}
+
+type loggerKey struct{}
+
+// contextWithLogger attaches a request-scoped logger (e.g. carrying token_hash).
+func contextWithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// log returns the request-scoped logger from ctx, or the client's logger.
+func (c *Client) log(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return c.logger
+}
+
+// tokenHash identifies an album in logs without revealing its token.
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:6])
+}
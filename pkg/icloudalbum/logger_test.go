@@ -0,0 +1,62 @@
+// ABOUTME: Test suite for structured logging plumbing
+// ABOUTME: Checks the silent default, injected loggers and token hashing
+package icloudalbum
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDefaultLoggerIsSilent(t *testing.T) {
+	if defaultLogger().Enabled(context.Background(), slog.LevelError) {
+		t.Error("default logger should discard all records")
+	}
+}
+
+func TestTokenHash(t *testing.T) {
+	h := tokenHash("B0aGWZuqDGKjsR")
+	if len(h) != 12 || strings.Contains(h, "B0aGWZuqDGKjsR") {
+		t.Errorf("tokenHash() = %q, want 12 hex chars", h)
+	}
+	if h != tokenHash("B0aGWZuqDGKjsR") {
+		t.Error("tokenHash() should be stable")
+	}
+}
+
+func TestClient_LogsStructuredAttributes(t *testing.T) {
+	srv := newFakeAlbumServer(t, fakeAlbum{
+		webstream: func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, map[string]any{
+				"streamName": "Album",
+				"photos": []map[string]any{{
+					"photoGuid":   "guid1",
+					"derivatives": map[string]any{"1": map[string]any{"checksum": "sum1"}},
+				}},
+			})
+		},
+		webasseturls: func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, map[string]any{"items": map[string]any{"guid1": map[string]any{"url_location": ""}}})
+		},
+	})
+
+	var buf bytes.Buffer
+	l := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	c := NewClient(WithBaseURL(srv.URL), WithLogger(l))
+	if _, err := c.Fetch(context.Background(), "B0aGWZuqDGKjsR"); err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{"token_hash=" + tokenHash("B0aGWZuqDGKjsR"), "endpoint=webasseturls", "guid=guid1"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log output missing %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "B0aGWZuqDGKjsR") {
+		t.Error("log output should not contain the raw token")
+	}
+}
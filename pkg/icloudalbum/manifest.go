@@ -0,0 +1,150 @@
+// ABOUTME: Download manifest kept in the output directory for idempotent re-runs
+// ABOUTME: Records checksum, path, size and SHA-256 per photo and verifies files on disk
+package icloudalbum
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ManifestFileName is the manifest DownloadAlbum maintains in its output
+// directory when DownloadOptions.UseManifest is set.
+const ManifestFileName = "icloudalbum-manifest.json"
+
+// Manifest maps PhotoGUID to the file downloaded for it.
+type Manifest struct {
+	Version int                      `json:"version"`
+	Photos  map[string]ManifestEntry `json:"photos"`
+
+	mu sync.Mutex
+}
+
+// ManifestEntry describes one downloaded file. Path is relative to the output
+// directory, with forward slashes.
+type ManifestEntry struct {
+	Checksum      string `json:"checksum"`
+	DerivativeKey string `json:"derivativeKey,omitempty"`
+	Path          string `json:"path"`
+	Size          int64  `json:"size"`
+	SHA256        string `json:"sha256"`
+}
+
+// ManifestState is what the manifest said about a photo before it was processed.
+type ManifestState string
+
+const (
+	ManifestNew       ManifestState = "new"       // not recorded yet
+	ManifestUnchanged ManifestState = "unchanged" // file verified on disk; skipped
+	ManifestChanged   ManifestState = "changed"   // selected derivative checksum changed
+	ManifestMissing   ManifestState = "missing"   // recorded file is gone
+	ManifestCorrupt   ManifestState = "corrupt"   // recorded file has the wrong size or SHA-256
+)
+
+// LoadManifest reads the manifest in dir. A missing manifest yields an empty one.
+func LoadManifest(dir string) (*Manifest, error) {
+	m := &Manifest{Version: 1, Photos: map[string]ManifestEntry{}}
+	b, err := os.ReadFile(filepath.Join(dir, ManifestFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(b, m); err != nil {
+		return &Manifest{Version: 1, Photos: map[string]ManifestEntry{}}, err
+	}
+	if m.Photos == nil {
+		m.Photos = map[string]ManifestEntry{}
+	}
+	return m, nil
+}
+
+// Save writes the manifest to dir, replacing any previous one atomically.
+func (m *Manifest) Save(dir string) error {
+	m.mu.Lock()
+	b, err := json.MarshalIndent(m, "", "  ")
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+ManifestFileName+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, ManifestFileName))
+}
+
+// check compares the recorded entry for guid against the derivative checksum
+// that would be downloaded now and against the file on disk.
+func (m *Manifest) check(dir, guid, checksum string) (ManifestState, ManifestEntry) {
+	m.mu.Lock()
+	e, ok := m.Photos[guid]
+	m.mu.Unlock()
+	switch {
+	case !ok:
+		return ManifestNew, e
+	case e.Checksum != checksum:
+		return ManifestChanged, e
+	case !filepath.IsLocal(filepath.FromSlash(e.Path)):
+		return ManifestMissing, e
+	}
+	path := filepath.Join(dir, filepath.FromSlash(e.Path))
+	info, err := os.Stat(path)
+	if err != nil {
+		return ManifestMissing, e
+	}
+	if info.Size() != e.Size {
+		return ManifestCorrupt, e
+	}
+	if sum, _, err := fileSHA256(path); err != nil || sum != e.SHA256 {
+		return ManifestCorrupt, e
+	}
+	return ManifestUnchanged, e
+}
+
+// record stores the file just downloaded (and post-processed) for guid,
+// measuring its size and SHA-256 as it is now on disk.
+func (m *Manifest) record(dir, guid string, e ManifestEntry, path string) error {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return err
+	}
+	sum, size, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	e.Path, e.SHA256, e.Size = filepath.ToSlash(rel), sum, size
+	m.mu.Lock()
+	m.Photos[guid] = e
+	m.mu.Unlock()
+	return nil
+}
+
+func fileSHA256(path string) (sum string, size int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if size, err = io.Copy(h, f); err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
@@ -0,0 +1,128 @@
+// ABOUTME: Test suite for the download manifest used for idempotent re-runs
+// ABOUTME: Covers skipping unchanged files and re-fetching changed, missing or corrupt ones
+package icloudalbum
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadManifest(t *testing.T) {
+	dir := t.TempDir()
+	m, err := LoadManifest(dir)
+	if err != nil || m.Photos == nil || len(m.Photos) != 0 {
+		t.Fatalf("LoadManifest(empty dir) = %+v, %v; want empty manifest", m, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, ManifestFileName), []byte("{not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := LoadManifest(dir); err == nil || m == nil || m.Photos == nil {
+		t.Errorf("LoadManifest(corrupt) = %+v, %v; want usable manifest and an error", m, err)
+	}
+}
+
+func TestClient_DownloadAlbum_Manifest(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, _ = w.Write([]byte{0xFF, 0xD8, 0xFF, 0xE0, byte(len(r.URL.Path))})
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	c := NewClient(WithDownloadHTTPClient(srv.Client()))
+	opts := DownloadOptions{OutputDir: dir, UseManifest: true}
+	resp := albumOf(srv, 4)
+
+	// First run downloads everything and records it.
+	report, err := c.DownloadAlbum(context.Background(), resp, opts)
+	if err != nil || report.Downloaded != 4 {
+		t.Fatalf("first run = %+v, %v; want 4 downloaded", report, err)
+	}
+	m, err := LoadManifest(dir)
+	if err != nil || len(m.Photos) != 4 {
+		t.Fatalf("manifest = %+v, %v; want 4 entries", m, err)
+	}
+	if e := m.Photos["g0"]; e.Checksum != "sum-g0" || e.Path != "1_g0.jpg" || e.Size != 5 || len(e.SHA256) != 64 {
+		t.Errorf("manifest entry g0 = %+v", e)
+	}
+	for _, res := range report.Results {
+		if res.Manifest != ManifestNew {
+			t.Errorf("first run %s manifest state = %q, want new", res.PhotoGUID, res.Manifest)
+		}
+	}
+
+	// Second run skips everything without touching the network.
+	hits.Store(0)
+	report, err = c.DownloadAlbum(context.Background(), resp, opts)
+	if err != nil || report.Unchanged != 4 || report.Downloaded != 0 || hits.Load() != 0 {
+		t.Fatalf("second run = %+v, %v, %d requests; want 4 unchanged and no requests", report, err, hits.Load())
+	}
+	if res := report.Results[0]; res.Path != filepath.Join(dir, "1_g0.jpg") || res.DerivativeKey != "original" || res.Bytes != 5 {
+		t.Errorf("unchanged result = %+v", res)
+	}
+
+	// Third run repairs a missing file, a corrupt file and a changed derivative.
+	if err := os.Remove(filepath.Join(dir, "1_g0.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "2_g1.jpg"), []byte{0xFF, 0xD8, 0xFF, 0xE0, 0}, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d := resp.Photos[2].Derivatives["original"]
+	d.Checksum = "sum-g2-new"
+	resp.Photos[2].Derivatives["original"] = d
+
+	hits.Store(0)
+	report, err = c.DownloadAlbum(context.Background(), resp, opts)
+	if err != nil || report.Downloaded != 3 || report.Unchanged != 1 || hits.Load() != 3 {
+		t.Fatalf("third run = %+v, %v, %d requests; want 3 downloaded and 1 unchanged", report, err, hits.Load())
+	}
+	want := []ManifestState{ManifestMissing, ManifestCorrupt, ManifestChanged, ManifestUnchanged}
+	for i, res := range report.Results {
+		if res.Manifest != want[i] {
+			t.Errorf("Results[%d].Manifest = %q, want %q", i, res.Manifest, want[i])
+		}
+	}
+	m, _ = LoadManifest(dir)
+	if m.Photos["g2"].Checksum != "sum-g2-new" {
+		t.Errorf("manifest g2 checksum = %q, want updated", m.Photos["g2"].Checksum)
+	}
+}
+
+func TestClient_DownloadAlbum_ManifestSavedAsPhotosFinish(t *testing.T) {
+	defer func(d time.Duration) { manifestSaveInterval = d }(manifestSaveInterval)
+	manifestSaveInterval = 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte{0xFF, 0xD8, 0xFF})
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	c := NewClient(WithDownloadHTTPClient(srv.Client()))
+	seen := 0
+	_, err := c.DownloadAlbum(context.Background(), albumOf(srv, 3), DownloadOptions{
+		OutputDir:   dir,
+		Concurrency: 1,
+		UseManifest: true,
+		OnResult: func(res PhotoResult) {
+			// The run is still going: what is on disk must already cover this photo.
+			seen++
+			m, err := LoadManifest(dir)
+			if err != nil || len(m.Photos) != seen {
+				t.Errorf("after %d photos manifest on disk = %v, %v; want %d entries", seen, m.Photos, err, seen)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
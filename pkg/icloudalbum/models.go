@@ -4,8 +4,11 @@ package icloudalbum
 
 import (
 	"encoding/json"
-	"log"
+	"fmt"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // -- Number-or-string helpers --------------------------------------------------
@@ -14,61 +17,100 @@ import (
 type Uint64OrString uint64
 
 func (u *Uint64OrString) UnmarshalJSON(b []byte) error {
-	// null → leave pointer nil (caller uses *Uint64OrString)
-	if string(b) == "null" {
-		return nil
+	v, ok, err := parseLenientUint(b, 64)
+	if err != nil {
+		// Schema drift: keep decoding; lenientWarnings reports the value.
+		defaultLogger().Warn("failed to parse value as u64", "value", string(b), "error", err)
 	}
-	// Try as number
-	var n uint64
-	if err := json.Unmarshal(b, &n); err == nil {
-		*u = Uint64OrString(n)
-		return nil
-	}
-	// Try as string
-	var s string
-	if err := json.Unmarshal(b, &s); err == nil {
-		if s == "" {
-			return nil
-		}
-		v, err := strconv.ParseUint(s, 10, 64)
-		if err != nil {
-			log.Printf("warn: failed to parse string %q as u64: %v", s, err)
-			return nil
-		}
+	if ok {
 		*u = Uint64OrString(v)
-		return nil
 	}
-	// Unknown type → ignore (schema drift)
 	return nil
 }
 
 type Uint32OrString uint32
 
 func (u *Uint32OrString) UnmarshalJSON(b []byte) error {
-	if string(b) == "null" {
-		return nil
+	v, ok, err := parseLenientUint(b, 32)
+	if err != nil {
+		defaultLogger().Warn("failed to parse value as u32", "value", string(b), "error", err)
 	}
-	// Try as number
-	var n uint64
-	if err := json.Unmarshal(b, &n); err == nil {
-		*u = Uint32OrString(uint32(n))
-		return nil
+	if ok {
+		*u = Uint32OrString(v)
 	}
-	// Try as string
-	var s string
-	if err := json.Unmarshal(b, &s); err == nil {
+	return nil
+}
+
+// parseLenientUint decodes a JSON number or quoted number that fits in bits.
+// ok is false for null, "" and values that fail to parse; err says why a
+// value failed.
+func parseLenientUint(b []byte, bits int) (v uint64, ok bool, err error) {
+	s := string(b)
+	if s == "null" {
+		return 0, false, nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return 0, false, err
+		}
 		if s == "" {
-			return nil
+			return 0, false, nil
 		}
-		v, err := strconv.ParseUint(s, 10, 32)
-		if err != nil {
-			log.Printf("warn: failed to parse string %q as u32: %v", s, err)
-			return nil
+	}
+	v, err = strconv.ParseUint(s, 10, bits)
+	if err != nil {
+		return 0, false, err
+	}
+	return v, true, nil
+}
+
+// lenientFields mirrors the lenient numeric fields of ApiResponse as raw JSON,
+// so values the lenient types had to drop can be reported.
+type lenientFields struct {
+	ItemsReturned json.RawMessage `json:"itemsReturned"`
+	Photos        []struct {
+		Width       json.RawMessage `json:"width"`
+		Height      json.RawMessage `json:"height"`
+		Derivatives map[string]struct {
+			FileSize json.RawMessage `json:"fileSize"`
+			Width    json.RawMessage `json:"width"`
+			Height   json.RawMessage `json:"height"`
+		} `json:"derivatives"`
+	} `json:"photos"`
+}
+
+// lenientWarnings returns one warning per lenient number in a webstream body
+// that could not be parsed and was decoded as absent.
+func lenientWarnings(raw []byte) []string {
+	var f lenientFields
+	_ = json.Unmarshal(raw, &f) // structural errors are reported by the main decode
+
+	var warnings []string
+	check := func(path string, b json.RawMessage, bits int) {
+		if len(b) == 0 {
+			return
+		}
+		if _, _, err := parseLenientUint(b, bits); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: ignoring %s: %v", path, b, err))
 		}
-		*u = Uint32OrString(uint32(v))
-		return nil
 	}
-	return nil
+	check("itemsReturned", f.ItemsReturned, 32)
+	for i, p := range f.Photos {
+		check(fmt.Sprintf("photos[%d].width", i), p.Width, 32)
+		check(fmt.Sprintf("photos[%d].height", i), p.Height, 32)
+		keys := make([]string, 0, len(p.Derivatives))
+		for k := range p.Derivatives {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			d := p.Derivatives[k]
+			check(fmt.Sprintf("photos[%d].derivatives[%q].fileSize", i, k), d.FileSize, 64)
+			check(fmt.Sprintf("photos[%d].derivatives[%q].width", i, k), d.Width, 32)
+			check(fmt.Sprintf("photos[%d].derivatives[%q].height", i, k), d.Height, 32)
+		}
+	}
+	return warnings
 }
 
 // -- Models --------------------------------------------------------------------
@@ -79,6 +121,10 @@ type Derivative struct {
 	Width    *Uint32OrString  `json:"width,omitempty"`
 	Height   *Uint32OrString  `json:"height,omitempty"`
 	URL      *string          `json:"url,omitempty"`
+	// URLIssuedAt is when Fetch obtained URL; URLExpiresAt is the expiry signed
+	// into URL, or zero when unknown. Both are zero for URLs set by hand.
+	URLIssuedAt  time.Time `json:"-"`
+	URLExpiresAt time.Time `json:"-"`
 }
 
 type Image struct {
@@ -89,6 +135,19 @@ type Image struct {
 	BatchDateCreated *string                    `json:"batchDateCreated,omitempty"`
 	Width            *Uint32OrString            `json:"width,omitempty"`
 	Height           *Uint32OrString            `json:"height,omitempty"`
+	ContributorFirstName *string `json:"contributorFirstName,omitempty"`
+	ContributorLastName  *string `json:"contributorLastName,omitempty"`
+	ContributorFullName  *string `json:"contributorFullName,omitempty"`
+
+	assetBase string // album base URL recorded by Fetch, used to refresh URLs
+}
+
+// Contributor returns the name of the person who added the photo, or "".
+func (img *Image) Contributor() string {
+	if name := strings.TrimSpace(derefOr(img.ContributorFullName, "")); name != "" {
+		return name
+	}
+	return strings.TrimSpace(derefOr(img.ContributorFirstName, "") + " " + derefOr(img.ContributorLastName, ""))
 }
 
 type Metadata struct {
@@ -114,4 +173,11 @@ type ApiResponse struct {
 type ICloudResponse struct {
 	Metadata Metadata
 	Photos   []Image
+	// Unchanged is set by FetchSince when the album has not changed since the
+	// given ctag; Photos is then empty and Metadata carries only StreamCTag.
+	Unchanged bool
+	// Host is the sharedstreams host that finally served the album.
+	Host string
+	// Diagnostics lists problems that did not fail the fetch.
+	Diagnostics Diagnostics
 }
@@ -100,6 +100,16 @@ func TestUint32OrString_UnmarshalJSON(t *testing.T) {
 			input:    `{"value": "4294967295"}`,
 			expected: 4294967295,
 		},
+		{
+			name:     "overflow is dropped",
+			input:    `{"value": 4294967296}`,
+			expected: 0,
+		},
+		{
+			name:     "non-numeric string is dropped",
+			input:    `{"value": "wide"}`,
+			expected: 0,
+		},
 	}
 
 	for _, tt := range tests {
@@ -227,3 +237,27 @@ func TestApiResponse_UnmarshalJSON(t *testing.T) {
 		t.Errorf("ItemsReturned = %v, want 1", resp.ItemsReturned)
 	}
 }
+
+func TestImage_Contributor(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want string
+	}{
+		{"full name", `{"photoGuid":"g","contributorFullName":"Ada Lovelace","contributorFirstName":"A"}`, "Ada Lovelace"},
+		{"first and last", `{"photoGuid":"g","contributorFirstName":"Ada","contributorLastName":"Lovelace"}`, "Ada Lovelace"},
+		{"first only", `{"photoGuid":"g","contributorFirstName":"Ada"}`, "Ada"},
+		{"none", `{"photoGuid":"g"}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var img Image
+			if err := json.Unmarshal([]byte(tt.json), &img); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if got := img.Contributor(); got != tt.want {
+				t.Errorf("Contributor() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+// ABOUTME: Sets downloaded files' modification and access times to the photo's capture time
+// ABOUTME: Uses DateCreated, falling back to BatchDateCreated, and reports unparseable dates
+package icloudalbum
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// captureTime returns when the photo was taken: DateCreated, or BatchDateCreated
+// when DateCreated is absent or unparseable. It returns the zero time when
+// neither is usable; err lists any date that was present but unparseable.
+func captureTime(photo *Image) (t time.Time, err error) {
+	var errs []error
+	for _, f := range []struct {
+		name  string
+		value *string
+	}{
+		{"dateCreated", photo.DateCreated},
+		{"batchDateCreated", photo.BatchDateCreated},
+	} {
+		if f.value == nil || *f.value == "" {
+			continue
+		}
+		parsed, perr := parseAppleDate(*f.value)
+		if perr != nil {
+			errs = append(errs, &DateError{PhotoGUID: photo.PhotoGUID, Field: f.name, Value: *f.value})
+			continue
+		}
+		if t.IsZero() {
+			t = parsed
+		}
+	}
+	return t, errors.Join(errs...)
+}
+
+// applyCaptureTime sets path's modification and access times to the photo's
+// capture time. The returned error reports unparseable dates; the times are
+// still set when a fallback date parsed.
+func applyCaptureTime(path string, photo *Image) error {
+	t, dateErr := captureTime(photo)
+	if t.IsZero() {
+		return dateErr
+	}
+	if err := os.Chtimes(path, t, t); err != nil {
+		return errors.Join(dateErr, err)
+	}
+	return dateErr
+}
@@ -0,0 +1,71 @@
+// ABOUTME: Test suite for applying photo capture dates as file modification times
+// ABOUTME: Covers DateCreated, the BatchDateCreated fallback and unparseable dates
+package icloudalbum
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCaptureTime(t *testing.T) {
+	tests := []struct {
+		name      string
+		created   *string
+		batch     *string
+		want      string // RFC3339, "" for zero
+		wantField string // field of the DateError, "" for none
+	}{
+		{"date created", strPtr("2020-01-02T03:04:05Z"), strPtr("2021-01-01T00:00:00Z"), "2020-01-02T03:04:05Z", ""},
+		{"falls back to batch", nil, strPtr("2021-01-01T00:00:00Z"), "2021-01-01T00:00:00Z", ""},
+		{"unparseable created uses batch", strPtr("last summer"), strPtr("2021-01-01T00:00:00Z"), "2021-01-01T00:00:00Z", "dateCreated"},
+		{"nothing usable", strPtr("??"), nil, "", "dateCreated"},
+		{"no dates", nil, nil, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := captureTime(&Image{PhotoGUID: "g", DateCreated: tt.created, BatchDateCreated: tt.batch})
+			if tt.want == "" && !got.IsZero() || tt.want != "" && got.UTC().Format(time.RFC3339) != tt.want {
+				t.Errorf("captureTime() = %v, want %q", got, tt.want)
+			}
+			var de *DateError
+			if tt.wantField == "" && err != nil || tt.wantField != "" && (!errors.As(err, &de) || de.Field != tt.wantField) {
+				t.Errorf("captureTime() error = %v, want DateError on %q", err, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestClient_DownloadSetsModTime(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte{0xFF, 0xD8, 0xFF})
+	}))
+	defer srv.Close()
+	c := NewClient(WithDownloadHTTPClient(srv.Client()))
+
+	photo := photoAt("g1", srv.URL+"/a")
+	photo.DateCreated = strPtr("2019-06-01T12:00:00Z")
+	fp, err := c.Download(context.Background(), photo, nil, t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Download() error = %v", err)
+	}
+	info, err := os.Stat(fp)
+	if want := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC); err != nil || !info.ModTime().Equal(want) {
+		t.Errorf("ModTime = %v (err %v), want %v", info.ModTime(), err, want)
+	}
+
+	resp := albumOf(srv, 1)
+	resp.Photos[0].DateCreated = strPtr("not a date")
+	report, err := c.DownloadAlbum(context.Background(), resp, DownloadOptions{OutputDir: t.TempDir()})
+	if err != nil || report.Downloaded != 1 {
+		t.Fatalf("DownloadAlbum() = %+v, %v", report, err)
+	}
+	var de *DateError
+	if !errors.As(report.Results[0].DateErr, &de) || de.Value != "not a date" {
+		t.Errorf("DateErr = %v, want DateError for the bad date", report.Results[0].DateErr)
+	}
+}
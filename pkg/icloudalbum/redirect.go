@@ -1,42 +1,219 @@
-// ABOUTME: Handles Apple's custom HTTP 330 redirect status for iCloud shared streams
-// ABOUTME: Extracts redirected host from JSON response to build correct base URL
+// ABOUTME: Follows Apple's custom 330 and standard 3xx redirects for iCloud shared streams
+// ABOUTME: Detects loops, limits hops, and caches the resolved base URL per album token
 package icloudalbum
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 )
 
 // GetRedirectedBaseURL detects Apple's custom 330 redirect and, if present,
 // constructs https://{host}/{token}/sharedstreams/. Otherwise returns baseURL.
 func GetRedirectedBaseURL(client *http.Client, baseURL, token string) (string, error) {
-	type payload struct {
-		StreamCTag *string `json:"streamCtag"` // null
-	}
-	body, _ := json.Marshal(payload{StreamCTag: nil})
-	req, err := http.NewRequest("POST", baseURL+"webstream", bytes.NewReader(body))
+	return GetRedirectedBaseURLContext(context.Background(), client, baseURL, token)
+}
+
+// GetRedirectedBaseURLContext is like GetRedirectedBaseURL but honors ctx.
+func GetRedirectedBaseURLContext(ctx context.Context, client *http.Client, baseURL, token string) (string, error) {
+	return NewClient(WithHTTPClient(client), withRedirectCache(legacyRedirects)).redirectedBaseURL(ctx, baseURL, token, "")
+}
+
+// redirectedBaseURL probes webstream with the same ctag the real fetch will send.
+func (c *Client) redirectedBaseURL(ctx context.Context, baseURL, token, ctag string) (string, error) {
+	resp, final, chain, err := c.resolveWebstream(ctx, token, baseURL, ctag)
 	if err != nil {
 		return "", err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
+	resp.Body.Close()
+	if len(chain) > 0 {
+		c.redirects.put(token, final)
+	}
+	return final, nil
+}
+
+// resolveWebstream POSTs webstream at baseURL and follows up to the client's
+// redirect limit of Apple 330 and standard 3xx hops. It returns the final, still
+// open response, the base URL that produced it and the hosts visited (empty when
+// there was no redirect). A 330 without a host is returned as-is.
+func (c *Client) resolveWebstream(ctx context.Context, token, baseURL, ctag string) (*http.Response, string, []string, error) {
+	var chain []string
+	seen := map[string]bool{baseURL: true}
+	for {
+		resp, err := c.postWebstream(ctx, baseURL, ctag)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		target, err := c.redirectFrom(resp, baseURL, token)
+		if err != nil {
+			resp.Body.Close()
+			return nil, "", nil, err
+		}
+		if target == "" {
+			return resp, baseURL, chain, nil
+		}
+		resp.Body.Close()
+
+		if len(chain) == 0 {
+			chain = append(chain, hostOf(baseURL))
+		}
+		chain = append(chain, hostOf(target))
+		if seen[target] {
+			return nil, "", nil, &RedirectError{Err: ErrRedirectLoop, Chain: chain}
+		}
+		if len(chain)-1 > c.maxRedirects {
+			return nil, "", nil, &RedirectError{Err: ErrTooManyRedirects, Chain: chain}
+		}
+		c.log(ctx).Debug("following webstream redirect", "endpoint", EndpointWebstream, "status", resp.StatusCode, "host", hostOf(target))
+		seen[target] = true
+		baseURL = target
 	}
-	defer resp.Body.Close()
+}
 
-	// Apple's server uses status 330 (non-standard) to signal redirect host in JSON.
-	if resp.StatusCode == 330 {
-		var m map[string]any
-		if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+// redirectFrom returns the new base URL a redirect response points at, or "" if
+// resp is not a redirect. It consumes the body of 330 responses.
+func (c *Client) redirectFrom(resp *http.Response, baseURL, token string) (string, error) {
+	switch resp.StatusCode {
+	case 330:
+		// Apple's server uses status 330 (non-standard) to signal redirect host in JSON.
+		return c.redirectTarget(resp.Body, token)
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		loc, err := resp.Location()
+		if err != nil {
+			return "", fmt.Errorf("webstream redirect (status %d): %w", resp.StatusCode, err)
+		}
+		cur, err := url.Parse(baseURL)
+		if err != nil {
 			return "", err
 		}
-		if host, _ := m["X-Apple-MMe-Host"].(string); host != "" {
-			return fmt.Sprintf("https://%s/%s/sharedstreams/", host, token), nil
+		if loc.User != nil {
+			return "", &HostNotAllowedError{Host: loc.Host, Source: "redirect", Reason: "contains userinfo"}
+		}
+		if loc.Host != cur.Host {
+			// checkHost sees the port too, so host:port is rejected.
+			if err := c.checkHost(loc.Host, "redirect"); err != nil {
+				return "", err
+			}
+			loc.Scheme = "https"
+		} else {
+			// Same host: never let Location downgrade https to http.
+			loc.Scheme = cur.Scheme
+		}
+		// Keep the redirect's path when it still names the webstream endpoint.
+		if strings.HasSuffix(loc.Path, "/webstream") {
+			return loc.Scheme + "://" + loc.Host + strings.TrimSuffix(loc.Path, "webstream"), nil
 		}
+		return fmt.Sprintf("%s://%s/%s/sharedstreams/", loc.Scheme, loc.Host, token), nil
+	}
+	return "", nil
+}
+
+// postWebstream sends the webstream request without following redirects; 330,
+// 304 and standard 3xx responses are returned to the caller.
+func (c *Client) postWebstream(ctx context.Context, baseURL, ctag string) (*http.Response, error) {
+	return c.do(ctx, apiCall{
+		endpoint: EndpointWebstream,
+		method:   "POST",
+		url:      baseURL + "webstream",
+		body:     webstreamPayload(ctag),
+		noFollow: true,
+		passStatus: []int{330, http.StatusNotModified,
+			http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+			http.StatusTemporaryRedirect, http.StatusPermanentRedirect},
+	})
+}
+
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// WithMaxRedirects limits how many webstream redirect hops are followed (default 5).
+func WithMaxRedirects(n int) Option {
+	return func(c *Client) { c.maxRedirects = n }
+}
+
+// redirectTarget reads a 330 body and returns https://{host}/{token}/sharedstreams/,
+// or "" when the body names no host. The host must pass the client's allowlist.
+func (c *Client) redirectTarget(body io.Reader, token string) (string, error) {
+	var m map[string]any
+	if err := json.NewDecoder(body).Decode(&m); err != nil {
+		return "", err
+	}
+	host, _ := m["X-Apple-MMe-Host"].(string)
+	if host == "" {
+		return "", nil
+	}
+	if err := c.checkHost(host, "redirect"); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("https://%s/%s/sharedstreams/", host, token), nil
+}
+
+// redirectCache remembers the redirected base URL per token so later fetches
+// go straight to the right partition. A nil cache or zero TTL disables it.
+type redirectCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]redirectEntry
+}
+
+type redirectEntry struct {
+	baseURL string
+	expires time.Time
+}
+
+// legacyRedirects is shared by the package-level functions, which build a new
+// Client per call, so their fetches still reuse known redirect targets.
+var legacyRedirects = newRedirectCache(time.Hour)
+
+func newRedirectCache(ttl time.Duration) *redirectCache {
+	return &redirectCache{ttl: ttl, now: time.Now, entries: map[string]redirectEntry{}}
+}
+
+func (rc *redirectCache) get(token string) (string, bool) {
+	if rc == nil || rc.ttl <= 0 {
+		return "", false
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	e, ok := rc.entries[token]
+	if !ok {
+		return "", false
+	}
+	if rc.now().After(e.expires) {
+		delete(rc.entries, token)
+		return "", false
+	}
+	return e.baseURL, true
+}
+
+func (rc *redirectCache) put(token, baseURL string) {
+	if rc == nil || rc.ttl <= 0 {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.entries[token] = redirectEntry{baseURL: baseURL, expires: rc.now().Add(rc.ttl)}
+}
+
+func (rc *redirectCache) forget(token string) {
+	if rc == nil {
+		return
 	}
-	// No redirect or missing host → use original
-	return baseURL, nil
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	delete(rc.entries, token)
 }
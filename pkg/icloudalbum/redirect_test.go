@@ -0,0 +1,172 @@
+// ABOUTME: Test suite for webstream redirect handling
+// ABOUTME: Covers chained 330 and standard 3xx hops, loop detection and hop limits
+package icloudalbum
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+// redirectingServer answers webstream with a 330 pointing at host.
+func redirectingServer(t *testing.T, host string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(330)
+		writeJSON(w, map[string]string{"X-Apple-MMe-Host": host})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func albumServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	return newFakeAlbumServer(t, fakeAlbum{
+		webstream: func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, map[string]any{"streamName": "Album", "photos": []any{}})
+		},
+	})
+}
+
+func TestClient_FetchFollowsRedirectChain(t *testing.T) {
+	final := albumServer(t)
+	// p02 answers with a standard 307 to p03, which serves the album.
+	p02 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://p03-sharedstreams.icloud.com"+r.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	defer p02.Close()
+	p01 := redirectingServer(t, "p02-sharedstreams.icloud.com")
+
+	c := NewClient(
+		WithBaseURL(p01.URL),
+		WithHTTPClient(routeTo(map[string]*httptest.Server{
+			"p02-sharedstreams.icloud.com": p02,
+			"p03-sharedstreams.icloud.com": final,
+		})),
+	)
+	resp, err := c.Fetch(context.Background(), "B0aGWZuqDGKjsR")
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if resp.Host != "p03-sharedstreams.icloud.com" {
+		t.Errorf("Host = %q, want p03-sharedstreams.icloud.com", resp.Host)
+	}
+	want := []string{hostOf(p01.URL), "p02-sharedstreams.icloud.com", "p03-sharedstreams.icloud.com"}
+	if !reflect.DeepEqual(resp.Diagnostics.RedirectChain, want) {
+		t.Errorf("RedirectChain = %v, want %v", resp.Diagnostics.RedirectChain, want)
+	}
+}
+
+func TestClient_FetchDetectsRedirectLoop(t *testing.T) {
+	p02 := redirectingServer(t, "p03-sharedstreams.icloud.com")
+	p03 := redirectingServer(t, "p02-sharedstreams.icloud.com")
+
+	c := NewClient(
+		WithBaseURL(p02.URL),
+		WithHTTPClient(routeTo(map[string]*httptest.Server{
+			"p02-sharedstreams.icloud.com": p02,
+			"p03-sharedstreams.icloud.com": p03,
+		})),
+	)
+	_, err := c.Fetch(context.Background(), "B0aGWZuqDGKjsR")
+	if !errors.Is(err, ErrRedirectLoop) {
+		t.Fatalf("Fetch() error = %v, want ErrRedirectLoop", err)
+	}
+	var re *RedirectError
+	if !errors.As(err, &re) || len(re.Chain) != 4 {
+		t.Errorf("RedirectError chain = %v, want 4 hosts", re)
+	}
+}
+
+func TestClient_FetchLimitsRedirects(t *testing.T) {
+	final := albumServer(t)
+	p02 := redirectingServer(t, "p03-sharedstreams.icloud.com")
+	p01 := redirectingServer(t, "p02-sharedstreams.icloud.com")
+	routes := routeTo(map[string]*httptest.Server{
+		"p02-sharedstreams.icloud.com": p02,
+		"p03-sharedstreams.icloud.com": final,
+	})
+
+	c := NewClient(WithBaseURL(p01.URL), WithHTTPClient(routes), WithMaxRedirects(1))
+	if _, err := c.Fetch(context.Background(), "B0aGWZuqDGKjsR"); !errors.Is(err, ErrTooManyRedirects) {
+		t.Errorf("Fetch() error = %v, want ErrTooManyRedirects", err)
+	}
+
+	c = NewClient(WithBaseURL(p01.URL), WithHTTPClient(routes), WithMaxRedirects(2))
+	if _, err := c.Fetch(context.Background(), "B0aGWZuqDGKjsR"); err != nil {
+		t.Errorf("Fetch() with two allowed hops error = %v", err)
+	}
+}
+
+func TestClient_StandardRedirectRejectsForeignHost(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "https://evil.example.com/x/sharedstreams/webstream", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	c := NewClient(WithBaseURL(srv.URL))
+	if _, err := c.Fetch(context.Background(), "B0aGWZuqDGKjsR"); !errors.Is(err, ErrHostNotAllowed) {
+		t.Errorf("Fetch() error = %v, want ErrHostNotAllowed", err)
+	}
+}
+
+func TestGetICloudPhotos_ReusesRedirectAcrossCalls(t *testing.T) {
+	const token = "B0bRedirectCache"
+	t.Cleanup(func() { legacyRedirects.forget(token) })
+
+	final := albumServer(t)
+	var probes atomic.Int32
+	partition := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		w.WriteHeader(330)
+		writeJSON(w, map[string]string{"X-Apple-MMe-Host": "p40-sharedstreams.icloud.com"})
+	}))
+	defer partition.Close()
+	client := routeTo(map[string]*httptest.Server{
+		"p37-sharedstreams.icloud.com": partition,
+		"p40-sharedstreams.icloud.com": final,
+	})
+
+	for i := 0; i < 3; i++ {
+		resp, err := GetICloudPhotosWithClient(token, client)
+		if err != nil {
+			t.Fatalf("call %d: GetICloudPhotosWithClient() error = %v", i, err)
+		}
+		if resp.Host != "p40-sharedstreams.icloud.com" {
+			t.Errorf("call %d: Host = %q", i, resp.Host)
+		}
+	}
+	if n := probes.Load(); n != 1 {
+		t.Errorf("partition host probed %d times, want 1", n)
+	}
+}
+
+func TestClient_RedirectFromKeepsHTTPS(t *testing.T) {
+	const base = "https://p01-sharedstreams.icloud.com/B0aGWZuqDGKjsR/sharedstreams/"
+	tests := []struct {
+		name     string
+		location string
+		want     string
+	}{
+		{"same host over http", "http://p01-sharedstreams.icloud.com/B0aGWZuqDGKjsR/sharedstreams/webstream", base},
+		{"relative", "/B0aGWZuqDGKjsR/sharedstreams/webstream", base},
+		{"other host over http", "http://p02-sharedstreams.icloud.com/B0aGWZuqDGKjsR/sharedstreams/webstream",
+			"https://p02-sharedstreams.icloud.com/B0aGWZuqDGKjsR/sharedstreams/"},
+	}
+	c := NewClient()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", base+"webstream", nil)
+			resp := &http.Response{StatusCode: http.StatusFound, Header: http.Header{"Location": {tt.location}}, Request: req}
+			got, err := c.redirectFrom(resp, base, "B0aGWZuqDGKjsR")
+			if err != nil || got != tt.want {
+				t.Errorf("redirectFrom() = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+// ABOUTME: Tracks when signed asset URLs were issued and when they expire
+// ABOUTME: Refreshes a photo's URLs via webasseturls when they are stale or rejected
+package icloudalbum
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// urlExpirySkew treats a URL as stale slightly before its stated expiry.
+const urlExpirySkew = time.Minute
+
+// WithAssetURLTTL sets how long an asset URL without an embedded expiry is
+// trusted after it was issued (default 30 minutes).
+func WithAssetURLTTL(ttl time.Duration) Option {
+	return func(c *Client) { c.assetURLTTL = ttl }
+}
+
+// parseURLExpiry reads the expiry Apple embeds in signed CDN URLs as the "e"
+// query parameter (Unix seconds). It returns the zero time when absent.
+func parseURLExpiry(raw string) time.Time {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return time.Time{}
+	}
+	q := u.Query()
+	for _, k := range []string{"e", "Expires"} {
+		if secs, err := strconv.ParseInt(q.Get(k), 10, 64); err == nil && secs > 0 {
+			return time.Unix(secs, 0)
+		}
+	}
+	return time.Time{}
+}
+
+// stampURLs records issue and expiry times on derivatives whose URL has no
+// issue time yet, and remembers baseURL so downloads can refresh them.
+func stampURLs(photos []Image, baseURL string, issued time.Time) {
+	for pi := range photos {
+		p := &photos[pi]
+		p.assetBase = baseURL
+		for k, d := range p.Derivatives {
+			if d.URL != nil && d.URLIssuedAt.IsZero() {
+				d.URLIssuedAt = issued
+				d.URLExpiresAt = parseURLExpiry(*d.URL)
+				p.Derivatives[k] = d
+			}
+		}
+	}
+}
+
+// urlStale reports whether d's URL has expired (or is about to) at now.
+func (c *Client) urlStale(d Derivative, now time.Time) bool {
+	switch {
+	case !d.URLExpiresAt.IsZero():
+		return !now.Add(urlExpirySkew).Before(d.URLExpiresAt)
+	case !d.URLIssuedAt.IsZero() && c.assetURLTTL > 0:
+		return now.Sub(d.URLIssuedAt) >= c.assetURLTTL
+	}
+	return false
+}
+
+// refreshPhotoURLs re-requests asset URLs for just this photo and replaces its
+// derivative URLs. The photo must come from Fetch (which records its album).
+func (c *Client) refreshPhotoURLs(ctx context.Context, photo *Image) error {
+	if photo.assetBase == "" {
+		return errors.New("photo has no album context to refresh URLs from")
+	}
+	urls, errs := c.assetURLs(ctx, photo.assetBase, []string{photo.PhotoGUID})
+	if len(urls) == 0 {
+		if err := errors.Join(errs...); err != nil {
+			return err
+		}
+		return errors.New("webasseturls returned no URLs for photo")
+	}
+	for k, d := range photo.Derivatives {
+		d.URL, d.URLIssuedAt, d.URLExpiresAt = nil, time.Time{}, time.Time{}
+		photo.Derivatives[k] = d
+	}
+	one := []Image{*photo}
+	EnrichPhotosWithURLs(one, urls)
+	stampURLs(one, photo.assetBase, time.Now())
+	c.log(ctx).Debug("refreshed asset URLs", "endpoint", EndpointAssetURLs, "guid", photo.PhotoGUID)
+	return nil
+}
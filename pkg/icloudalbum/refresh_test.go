@@ -0,0 +1,183 @@
+// ABOUTME: Test suite for signed asset URL expiry tracking and refresh
+// ABOUTME: Covers expiry parsing, staleness checks, and refresh on 403 or stale URLs
+package icloudalbum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseURLExpiry(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		want time.Time
+	}{
+		{"e parameter", "https://cvws.icloud-content.com/B/abc?o=x&e=1700000000", time.Unix(1700000000, 0)},
+		{"Expires parameter", "https://cvws.icloud-content.com/B/abc?Expires=1700000000", time.Unix(1700000000, 0)},
+		{"no expiry", "https://cvws.icloud-content.com/B/abc", time.Time{}},
+		{"non-numeric", "https://cvws.icloud-content.com/B/abc?e=soon", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseURLExpiry(tt.url); !got.Equal(tt.want) {
+				t.Errorf("parseURLExpiry(%q) = %v, want %v", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClient_URLStale(t *testing.T) {
+	now := time.Now()
+	c := NewClient(WithAssetURLTTL(10 * time.Minute))
+	tests := []struct {
+		name string
+		d    Derivative
+		want bool
+	}{
+		{"unstamped", Derivative{}, false},
+		{"fresh by expiry", Derivative{URLExpiresAt: now.Add(time.Hour)}, false},
+		{"within skew of expiry", Derivative{URLExpiresAt: now.Add(30 * time.Second)}, true},
+		{"expired", Derivative{URLExpiresAt: now.Add(-time.Minute)}, true},
+		{"fresh by TTL", Derivative{URLIssuedAt: now.Add(-time.Minute)}, false},
+		{"past TTL", Derivative{URLIssuedAt: now.Add(-11 * time.Minute)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.urlStale(tt.d, now); got != tt.want {
+				t.Errorf("urlStale() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// refreshingAlbum serves one photo whose asset URL changes on every
+// webasseturls call. firstQuery is appended to the first URL it hands out.
+func refreshingAlbum(t *testing.T, firstQuery string, assets http.HandlerFunc) (*httptest.Server, *atomic.Int32) {
+	var urlCalls atomic.Int32
+	srv := newFakeAlbumServer(t, fakeAlbum{
+		webstream: func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, map[string]any{
+				"streamName":    "Album",
+				"itemsReturned": "1",
+				"photos": []map[string]any{{
+					"photoGuid":   "guid1",
+					"derivatives": map[string]any{"original": map[string]any{"checksum": "sum1"}},
+				}},
+			})
+		},
+		webasseturls: func(w http.ResponseWriter, r *http.Request) {
+			n := urlCalls.Add(1)
+			path := fmt.Sprintf("/assets/v%d", n)
+			if n == 1 {
+				path += firstQuery
+			}
+			writeJSON(w, map[string]any{"items": map[string]any{
+				"sum1": map[string]any{"url_location": "cvws.icloud-content.com", "url_path": path},
+			}})
+		},
+		assets: assets,
+	})
+	return srv, &urlCalls
+}
+
+func TestClient_DownloadRefreshesURLs(t *testing.T) {
+	jpeg := []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x10}
+	tests := []struct {
+		name       string
+		firstQuery string
+		assets     http.HandlerFunc
+		wantErr    bool
+		wantCalls  int32
+	}{
+		{
+			name:       "403 on first URL",
+			firstQuery: "",
+			assets: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/assets/v1" {
+					http.Error(w, "expired", http.StatusForbidden)
+					return
+				}
+				_, _ = w.Write(jpeg)
+			},
+			wantCalls: 2,
+		},
+		{
+			name:       "410 on first URL",
+			firstQuery: "",
+			assets: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/assets/v1" {
+					http.Error(w, "gone", http.StatusGone)
+					return
+				}
+				_, _ = w.Write(jpeg)
+			},
+			wantCalls: 2,
+		},
+		{
+			name:       "expired signature refreshed before request",
+			firstQuery: fmt.Sprintf("?e=%d", time.Now().Add(-time.Hour).Unix()),
+			assets: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/assets/v1" {
+					t.Error("stale URL should not be requested")
+				}
+				_, _ = w.Write(jpeg)
+			},
+			wantCalls: 2,
+		},
+		{
+			name:       "persistent 403 fails after one refresh",
+			firstQuery: "",
+			assets: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "denied", http.StatusForbidden)
+			},
+			wantErr:   true,
+			wantCalls: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, urlCalls := refreshingAlbum(t, tt.firstQuery, tt.assets)
+			c := NewClient(
+				WithBaseURL(srv.URL),
+				WithHTTPClient(srv.Client()),
+				WithDownloadHTTPClient(routeTo(map[string]*httptest.Server{"cvws.icloud-content.com": srv})),
+			)
+			resp, err := c.Fetch(context.Background(), "B0aGWZuqDGKjsR")
+			if err != nil {
+				t.Fatalf("Fetch() error = %v", err)
+			}
+			if resp.Photos[0].Derivatives["original"].URLIssuedAt.IsZero() {
+				t.Error("Fetch should stamp URLIssuedAt")
+			}
+
+			fp, err := c.Download(context.Background(), &resp.Photos[0], nil, t.TempDir(), nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Download() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := urlCalls.Load(); got != tt.wantCalls {
+				t.Errorf("webasseturls calls = %d, want %d", got, tt.wantCalls)
+			}
+			if tt.wantErr {
+				var se *HTTPStatusError
+				if !errors.As(err, &se) || se.StatusCode != http.StatusForbidden {
+					t.Errorf("Download() error = %v, want HTTPStatusError 403", err)
+				} else if se.Attempts != 2 {
+					t.Errorf("Attempts = %d, want 2 (before and after the refresh)", se.Attempts)
+				}
+				return
+			}
+			if b, err := os.ReadFile(fp); err != nil || len(b) != len(jpeg) {
+				t.Errorf("downloaded file = %d bytes, err %v", len(b), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+// ABOUTME: Resumable downloads backed by .partial files and a JSON state sidecar
+// ABOUTME: Continues interrupted transfers with HTTP Range, validated by Content-Range and ETag
+package icloudalbum
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// WithResumableDownloads controls whether interrupted downloads keep their
+// .partial file for a later Range resume (default true). When disabled, a
+// failed download removes its partial data.
+func WithResumableDownloads(enabled bool) Option {
+	return func(c *Client) { c.resumable = enabled }
+}
+
+// partialState is stored as <name>.partial.json beside a .partial download and
+// identifies the content the partial bytes belong to.
+type partialState struct {
+	URL      string `json:"url"`
+	Checksum string `json:"checksum"`
+	FileSize uint64 `json:"fileSize,omitempty"`
+	ETag     string `json:"etag,omitempty"`
+}
+
+// fetchToFile downloads the photo's selected derivative to name(ext), where ext
+// is sniffed from the content. Data is written to name("") + ".partial" and
+// renamed into place once complete; a matching partial from an earlier attempt
+// is resumed.
+func (c *Client) fetchToFile(ctx context.Context, photo *Image, name namer) (saved savedFile, err error) {
+	partial, err := name("")
+	if err != nil {
+		return savedFile{}, err
+	}
+	partial += ".partial"
+	sidecar := partial + ".json"
+	if err := os.MkdirAll(filepath.Dir(partial), 0o755); err != nil {
+		return savedFile{}, err
+	}
+
+	var state partialState
+	var offset int64
+	if c.resumable {
+		offset, state = c.resumeOffset(photo, partial, sidecar)
+	}
+	resp, key, d, offset, err := c.requestFrom(ctx, photo, offset, state.ETag)
+	if err != nil {
+		return savedFile{}, err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_RDWR | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(partial, flags, 0o644)
+	if err != nil {
+		return savedFile{}, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			if !c.resumable {
+				os.Remove(partial)
+				os.Remove(sidecar)
+			}
+		}
+	}()
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return savedFile{}, err
+	}
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" && offset > 0 {
+		etag = state.ETag
+	}
+	state = partialState{URL: derefOr(d.URL, ""), Checksum: d.Checksum, FileSize: fileSizeOf(d), ETag: etag}
+	if c.resumable {
+		if err = writePartialState(sidecar, state); err != nil {
+			return savedFile{}, err
+		}
+	}
+
+	n, err := io.Copy(f, resp.Body)
+	if err != nil {
+		return savedFile{}, err
+	}
+	total := offset + n
+	if offset > 0 && state.FileSize > 0 && uint64(total) != state.FileSize {
+		// The spliced file cannot be trusted; start over next time.
+		f.Close()
+		os.Remove(partial)
+		os.Remove(sidecar)
+		return savedFile{}, fmt.Errorf("resumed download of %s is %d bytes, want %d", photo.PhotoGUID, total, state.FileSize)
+	}
+
+	head := make([]byte, sniffLen)
+	m, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return savedFile{}, err
+	}
+	if err = f.Sync(); err != nil {
+		return savedFile{}, err
+	}
+	if err = f.Close(); err != nil {
+		return savedFile{}, err
+	}
+	fp, err := name(GetExtensionForContent(head[:m], ""))
+	if err != nil {
+		return savedFile{}, err
+	}
+	if err = os.MkdirAll(filepath.Dir(fp), 0o755); err != nil {
+		return savedFile{}, err
+	}
+	if err = os.Rename(partial, fp); err != nil {
+		return savedFile{}, err
+	}
+	os.Remove(sidecar)
+	return savedFile{path: fp, key: key, bytes: total}, nil
+}
+
+// resumeOffset returns how many bytes of partial can be reused, and the state
+// recorded for them. It returns zero unless the sidecar describes the derivative
+// that would be fetched now.
+func (c *Client) resumeOffset(photo *Image, partial, sidecar string) (int64, partialState) {
+	var st partialState
+	b, err := os.ReadFile(sidecar)
+	if err != nil || json.Unmarshal(b, &st) != nil || st.Checksum == "" {
+		return 0, partialState{}
+	}
+	info, err := os.Stat(partial)
+	if err != nil || info.Size() == 0 {
+		return 0, partialState{}
+	}
+	_, d, _, ok := c.selectDerivative(photo.Derivatives)
+	if !ok || d.Checksum != st.Checksum || fileSizeOf(d) != st.FileSize {
+		return 0, partialState{}
+	}
+	if st.FileSize > 0 && uint64(info.Size()) >= st.FileSize {
+		return 0, partialState{}
+	}
+	return info.Size(), st
+}
+
+// requestFrom requests the selected derivative starting at offset. The returned
+// offset is where the response body actually starts: zero when the server
+// ignored the Range or the partial bytes no longer match the remote content.
+func (c *Client) requestFrom(ctx context.Context, photo *Image, offset int64, etag string) (*http.Response, string, Derivative, int64, error) {
+	var header http.Header
+	if offset > 0 {
+		header = http.Header{"Range": {fmt.Sprintf("bytes=%d-", offset)}}
+		if etag != "" {
+			header.Set("If-Range", etag)
+		}
+	}
+	resp, key, d, err := c.getDerivative(ctx, photo, header)
+	if err != nil || offset == 0 {
+		return resp, key, d, 0, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && validRange(resp, offset, d, etag):
+		c.log(ctx).Debug("resuming download", "guid", photo.PhotoGUID, "offset", offset)
+		return resp, key, d, offset, nil
+	case resp.StatusCode == http.StatusOK:
+		c.log(ctx).Debug("server sent full content for range request", "guid", photo.PhotoGUID)
+		return resp, key, d, 0, nil
+	}
+	resp.Body.Close()
+	c.log(ctx).Info("partial download no longer matches; restarting", "guid", photo.PhotoGUID, "status", resp.StatusCode)
+	return c.requestFrom(ctx, photo, 0, "")
+}
+
+// validRange reports whether a 206 response continues exactly at offset and
+// still describes the content recorded for the partial file.
+func validRange(resp *http.Response, offset int64, d Derivative, etag string) bool {
+	var start, end int64
+	var total string
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%s", &start, &end, &total); err != nil || start != offset {
+		return false
+	}
+	if size := fileSizeOf(d); size > 0 && total != "*" && total != strconv.FormatUint(size, 10) {
+		return false
+	}
+	if got := resp.Header.Get("ETag"); etag != "" && got != "" && got != etag {
+		return false
+	}
+	return true
+}
+
+func writePartialState(path string, st partialState) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
+
+func fileSizeOf(d Derivative) uint64 {
+	if d.FileSize == nil {
+		return 0
+	}
+	return uint64(*d.FileSize)
+}
@@ -0,0 +1,203 @@
+// ABOUTME: Test suite for resumable downloads using .partial files and Range requests
+// ABOUTME: Covers resume, servers ignoring Range, changed content and interrupted transfers
+package icloudalbum
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestValidRange(t *testing.T) {
+	size := Uint64OrString(2000)
+	d := Derivative{FileSize: &size}
+	tests := []struct {
+		name   string
+		cr     string
+		etag   string
+		offset int64
+		want   bool
+	}{
+		{"matching range", "bytes 800-1999/2000", "", 800, true},
+		{"unknown total", "bytes 800-1999/*", "", 800, true},
+		{"wrong start", "bytes 0-1999/2000", "", 800, false},
+		{"wrong total", "bytes 800-2999/3000", "", 800, false},
+		{"missing header", "", "", 800, false},
+		{"etag changed", "bytes 800-1999/2000", `"v2"`, 800, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			resp.Header.Set("Content-Range", tt.cr)
+			if tt.etag != "" {
+				resp.Header.Set("ETag", tt.etag)
+			}
+			if got := validRange(resp, tt.offset, d, `"v1"`); got != tt.want {
+				t.Errorf("validRange(%q) = %v, want %v", tt.cr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClient_DownloadResumes(t *testing.T) {
+	content := append([]byte{0xFF, 0xD8, 0xFF, 0xE0}, bytes.Repeat([]byte{1}, 1996)...)
+	changed := append([]byte{0xFF, 0xD8, 0xFF, 0xE0}, bytes.Repeat([]byte{2}, 1996)...)
+	const have = 800
+
+	partialContent := func(w http.ResponseWriter, body []byte, start int, etag string) {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(body)-1, len(body)))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(body[start:])
+	}
+
+	tests := []struct {
+		name       string
+		checksum   string // recorded in the sidecar
+		full       []byte // served without a Range header
+		ranged     func(w http.ResponseWriter)
+		want       []byte
+		wantRanged bool
+	}{
+		{
+			name:       "resumes with 206",
+			checksum:   "sum-p",
+			full:       content,
+			ranged:     func(w http.ResponseWriter) { partialContent(w, content, have, `"v1"`) },
+			want:       content,
+			wantRanged: true,
+		},
+		{
+			name:       "server ignores Range",
+			checksum:   "sum-p",
+			full:       content,
+			ranged:     func(w http.ResponseWriter) { _, _ = w.Write(content) },
+			want:       content,
+			wantRanged: true,
+		},
+		{
+			name:       "content changed behind the same URL",
+			checksum:   "sum-p",
+			full:       changed,
+			ranged:     func(w http.ResponseWriter) { partialContent(w, changed, have, `"v2"`) },
+			want:       changed,
+			wantRanged: true,
+		},
+		{
+			name:       "range starts at wrong offset",
+			checksum:   "sum-p",
+			full:       content,
+			ranged:     func(w http.ResponseWriter) { partialContent(w, content, 0, `"v1"`) },
+			want:       content,
+			wantRanged: true,
+		},
+		{
+			name:     "range not satisfiable",
+			checksum: "sum-p",
+			full:     content,
+			ranged: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			},
+			want:       content,
+			wantRanged: true,
+		},
+		{
+			name:       "derivative checksum changed",
+			checksum:   "sum-old",
+			full:       changed,
+			ranged:     func(w http.ResponseWriter) { t.Error("stale partial should not be resumed") },
+			want:       changed,
+			wantRanged: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ranged atomic.Bool
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if rg := r.Header.Get("Range"); rg != "" {
+					ranged.Store(true)
+					if rg != fmt.Sprintf("bytes=%d-", have) || r.Header.Get("If-Range") != `"v1"` {
+						t.Errorf("Range = %q, If-Range = %q", rg, r.Header.Get("If-Range"))
+					}
+					tt.ranged(w)
+					return
+				}
+				_, _ = w.Write(tt.full)
+			}))
+			defer srv.Close()
+
+			dir := t.TempDir()
+			photo := photoAt("p", srv.URL+"/asset")
+			size := Uint64OrString(len(content))
+			d := photo.Derivatives["original"]
+			d.FileSize = &size
+			photo.Derivatives["original"] = d
+
+			partial := filepath.Join(dir, "p.partial")
+			if err := os.WriteFile(partial, content[:have], 0o644); err != nil {
+				t.Fatal(err)
+			}
+			st, _ := json.Marshal(partialState{URL: srv.URL + "/asset", Checksum: tt.checksum, FileSize: uint64(len(content)), ETag: `"v1"`})
+			if err := os.WriteFile(partial+".json", st, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			c := NewClient(WithDownloadHTTPClient(srv.Client()), WithRetryConfig(fastRetry(0)))
+			fp, err := c.Download(context.Background(), photo, nil, dir, nil)
+			if err != nil {
+				t.Fatalf("Download() error = %v", err)
+			}
+			if ranged.Load() != tt.wantRanged {
+				t.Errorf("range request sent = %v, want %v", ranged.Load(), tt.wantRanged)
+			}
+			got, err := os.ReadFile(fp)
+			if err != nil || !bytes.Equal(got, tt.want) {
+				t.Errorf("downloaded %d bytes (err %v), want the expected %d", len(got), err, len(tt.want))
+			}
+			for _, leftover := range []string{partial, partial + ".json"} {
+				if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+					t.Errorf("%s should be removed after success", filepath.Base(leftover))
+				}
+			}
+		})
+	}
+}
+
+func TestClient_DownloadKeepsPartialOnInterrupt(t *testing.T) {
+	content := append([]byte{0xFF, 0xD8, 0xFF, 0xE0}, bytes.Repeat([]byte{1}, 4000)...)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		_, _ = w.Write(content[:1000])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	c := NewClient(WithDownloadHTTPClient(srv.Client()), WithRetryConfig(fastRetry(0)))
+	if _, err := c.Download(context.Background(), photoAt("p", srv.URL+"/asset"), nil, dir, nil); err == nil {
+		t.Fatal("Download() should fail on a truncated body")
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "p.partial"))
+	if err != nil || info.Size() != 1000 {
+		t.Fatalf("partial file = %v, %v; want 1000 bytes", info, err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "p.partial.json"))
+	if err != nil {
+		t.Fatalf("sidecar missing: %v", err)
+	}
+	var st partialState
+	if err := json.Unmarshal(b, &st); err != nil || st.Checksum != "sum-p" || st.ETag != `"v1"` || st.URL != srv.URL+"/asset" {
+		t.Errorf("sidecar = %+v (err %v)", st, err)
+	}
+}
@@ -0,0 +1,274 @@
+// ABOUTME: Shared retry executor with configurable backoff strategies for every request
+// ABOUTME: Supports per-endpoint retry policies and honors server Retry-After headers
+package icloudalbum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type BackoffStrategy int
+
+const (
+	BackoffConstant BackoffStrategy = iota
+	BackoffLinear
+	BackoffExponential
+	BackoffExponentialWithJitter
+)
+
+type RetryConfig struct {
+	MaxRetries                  int
+	BaseDelay                   time.Duration
+	Strategy                    BackoffStrategy
+	MaxDelay                    time.Duration
+	RetryableStatusCodes        []int // specific codes
+	PermanentFailureStatusCodes []int
+}
+
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxRetries:                  3,
+		BaseDelay:                   500 * time.Millisecond,
+		Strategy:                    BackoffExponentialWithJitter,
+		MaxDelay:                    30 * time.Second,
+		RetryableStatusCodes:        []int{408, 429, 500, 502, 503, 504},
+		PermanentFailureStatusCodes: []int{400, 401, 403, 404},
+	}
+}
+
+func shouldRetryStatus(cfg RetryConfig, code int) bool {
+	for _, s := range cfg.PermanentFailureStatusCodes {
+		if code == s {
+			return false
+		}
+	}
+	for _, s := range cfg.RetryableStatusCodes {
+		if code == s {
+			return true
+		}
+	}
+	return code >= 500 && code <= 599
+}
+
+func nextDelay(cfg RetryConfig, attempt int) time.Duration {
+	switch cfg.Strategy {
+	case BackoffConstant:
+		return cfg.BaseDelay
+	case BackoffLinear:
+		d := time.Duration(attempt) * cfg.BaseDelay
+		if d > cfg.MaxDelay {
+			return cfg.MaxDelay
+		}
+		return d
+	case BackoffExponential:
+		d := cfg.BaseDelay * (1 << min(attempt, 30))
+		if d > cfg.MaxDelay {
+			return cfg.MaxDelay
+		}
+		return d
+	case BackoffExponentialWithJitter:
+		max := cfg.BaseDelay * (1 << min(attempt, 30))
+		if max > cfg.MaxDelay {
+			max = cfg.MaxDelay
+		}
+		if max <= 0 {
+			return 0
+		}
+		return time.Duration(rand.Int64N(max.Milliseconds()+1)) * time.Millisecond
+	default:
+		return cfg.BaseDelay
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// sleepContext waits for d or until ctx is done, whichever comes first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Endpoint identifies a class of request for per-endpoint retry tuning.
+type Endpoint string
+
+const (
+	EndpointWebstream Endpoint = "webstream"
+	EndpointAssetURLs Endpoint = "webasseturls"
+	EndpointDownload  Endpoint = "download"
+)
+
+// WithEndpointRetryConfig overrides the retry policy for one endpoint; other
+// endpoints keep the policy set by WithRetryConfig.
+func WithEndpointRetryConfig(ep Endpoint, cfg RetryConfig) Option {
+	return func(c *Client) {
+		m := make(map[Endpoint]RetryConfig, len(c.endpointRetry)+1)
+		for k, v := range c.endpointRetry {
+			m[k] = v
+		}
+		m[ep] = cfg
+		c.endpointRetry = m
+	}
+}
+
+func (c *Client) retryConfig(ep Endpoint) RetryConfig {
+	if cfg, ok := c.endpointRetry[ep]; ok {
+		return cfg
+	}
+	return c.retry
+}
+
+// apiCall describes one logical request; do rebuilds it for every attempt.
+type apiCall struct {
+	endpoint Endpoint
+	method   string
+	url      string
+	body     []byte
+	header   http.Header
+	// noFollow hands 3xx responses back instead of letting net/http follow them.
+	noFollow bool
+	// passStatus lists non-2xx statuses handed back to the caller instead of
+	// being retried or turned into errors (e.g. Apple's 330 redirect).
+	passStatus []int
+	// attempts, if set, is incremented for every request sent, so callers that
+	// issue several calls can report the total.
+	attempts *int
+}
+
+// do runs call with the endpoint's retry policy. It returns the response for
+// 2xx and passStatus codes; the caller must close its body.
+func (c *Client) do(ctx context.Context, call apiCall) (*http.Response, error) {
+	rc := c.retryConfig(call.endpoint)
+	hc := c.httpClient
+	if call.endpoint == EndpointDownload {
+		hc = c.downloadClient
+	}
+	if call.noFollow {
+		nf := *hc
+		nf.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+		hc = &nf
+	}
+
+	attempt := 0
+	for {
+		req, err := c.newRequest(ctx, call.method, call.url, call.body)
+		if err != nil {
+			return nil, err
+		}
+		for k, vs := range call.header {
+			req.Header[k] = vs
+		}
+
+		if call.attempts != nil {
+			*call.attempts++
+		}
+		resp, err := hc.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			// treat as retryable network error
+			c.log(ctx).Debug("request failed", "endpoint", call.endpoint, "attempt", attempt+1, "error", err)
+			if attempt >= rc.MaxRetries {
+				return nil, fmt.Errorf("%s network error after %d attempts: %w", call.endpoint, attempt+1, err)
+			}
+			if err := sleepContext(ctx, nextDelay(rc, attempt)); err != nil {
+				return nil, err
+			}
+			attempt++
+			continue
+		}
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 || containsInt(call.passStatus, resp.StatusCode) {
+			return resp, nil
+		}
+
+		resp.Body.Close()
+		retryAfter, hasRetryAfter := parseRetryAfter(resp.Header, time.Now())
+		if shouldRetryStatus(rc, resp.StatusCode) && attempt < rc.MaxRetries {
+			delay := nextDelay(rc, attempt)
+			if hasRetryAfter {
+				delay = capDelay(rc, retryAfter)
+			}
+			c.log(ctx).Debug("retrying after status", "endpoint", call.endpoint, "attempt", attempt+1,
+				"status", resp.StatusCode, "delay", delay)
+			if err := sleepContext(ctx, delay); err != nil {
+				return nil, err
+			}
+			attempt++
+			continue
+		}
+		return nil, &HTTPStatusError{
+			Endpoint:   call.endpoint,
+			StatusCode: resp.StatusCode,
+			Attempts:   attempt + 1,
+			URL:        redactURL(call.url),
+			RetryAfter: retryAfter,
+		}
+	}
+}
+
+// parseRetryAfter reads a Retry-After header in either delta-seconds or
+// HTTP-date form. Dates in the past yield a zero delay.
+func parseRetryAfter(h http.Header, now time.Time) (time.Duration, bool) {
+	v := strings.TrimSpace(h.Get("Retry-After"))
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil || (errors.Is(err, strconv.ErrRange) && secs > 0) {
+		if secs < 0 {
+			return 0, false
+		}
+		// Saturate instead of overflowing into a negative delay; capDelay
+		// then limits it to MaxDelay.
+		if secs > int64(math.MaxInt64/time.Second) {
+			return time.Duration(math.MaxInt64), true
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := t.Sub(now)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// capDelay limits a server-requested delay to cfg.MaxDelay (when set).
+func capDelay(cfg RetryConfig, d time.Duration) time.Duration {
+	if cfg.MaxDelay > 0 && d > cfg.MaxDelay {
+		return cfg.MaxDelay
+	}
+	return d
+}
+
+func containsInt(xs []int, x int) bool {
+	for _, v := range xs {
+		if v == x {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+// ABOUTME: Test suite for the shared retry executor and per-endpoint retry policies
+// ABOUTME: Uses httptest servers that fail transiently before succeeding
+package icloudalbum
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func fastRetry(maxRetries int) RetryConfig {
+	cfg := DefaultRetryConfig()
+	cfg.MaxRetries = maxRetries
+	cfg.Strategy = BackoffConstant
+	cfg.BaseDelay = time.Millisecond
+	return cfg
+}
+
+func TestClientDo_RetriesTransientStatus(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := NewClient(WithHTTPClient(srv.Client()), WithRetryConfig(fastRetry(3)))
+	resp, err := c.do(context.Background(), apiCall{endpoint: EndpointWebstream, method: "POST", url: srv.URL, body: []byte("{}")})
+	if err != nil {
+		t.Fatalf("do() error = %v", err)
+	}
+	resp.Body.Close()
+	if hits.Load() != 3 {
+		t.Errorf("server hits = %d, want 3", hits.Load())
+	}
+}
+
+func TestClientDo_PassStatus(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(330)
+	}))
+	defer srv.Close()
+
+	c := NewClient(WithHTTPClient(srv.Client()), WithRetryConfig(fastRetry(3)))
+	resp, err := c.do(context.Background(), apiCall{endpoint: EndpointWebstream, method: "POST", url: srv.URL, passStatus: []int{330}})
+	if err != nil {
+		t.Fatalf("do() error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 330 || hits.Load() != 1 {
+		t.Errorf("status = %d, hits = %d; want 330 after one hit", resp.StatusCode, hits.Load())
+	}
+}
+
+func TestClientDo_EndpointOverride(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	c := NewClient(
+		WithHTTPClient(srv.Client()),
+		WithDownloadHTTPClient(srv.Client()),
+		WithRetryConfig(fastRetry(1)),
+		WithEndpointRetryConfig(EndpointDownload, fastRetry(4)),
+	)
+
+	if _, err := c.do(context.Background(), apiCall{endpoint: EndpointWebstream, method: "POST", url: srv.URL}); err == nil {
+		t.Fatal("do() should fail after retries")
+	}
+	if hits.Load() != 2 {
+		t.Errorf("webstream hits = %d, want 2", hits.Load())
+	}
+
+	hits.Store(0)
+	if _, err := c.do(context.Background(), apiCall{endpoint: EndpointDownload, method: "GET", url: srv.URL}); err == nil {
+		t.Fatal("do() should fail after retries")
+	}
+	if hits.Load() != 5 {
+		t.Errorf("download hits = %d, want 5", hits.Load())
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"absent", "", 0, false},
+		{"delta seconds", "120", 2 * time.Minute, true},
+		{"http date", now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{"date in the past", now.Add(-time.Hour).Format(http.TimeFormat), 0, true},
+		{"negative", "-5", 0, false},
+		{"huge delta saturates", "10000000000", time.Duration(math.MaxInt64), true},
+		{"beyond int64 saturates", "99999999999999999999", time.Duration(math.MaxInt64), true},
+		{"garbage", "soon", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			if tt.value != "" {
+				h.Set("Retry-After", tt.value)
+			}
+			got, ok := parseRetryAfter(h, now)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("parseRetryAfter(%q) = %v, %v; want %v, %v", tt.value, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	h := http.Header{"Retry-After": {"10000000000"}}
+	d, _ := parseRetryAfter(h, now)
+	if got := capDelay(RetryConfig{MaxDelay: 30 * time.Second}, d); got != 30*time.Second {
+		t.Errorf("capDelay(huge Retry-After) = %v, want MaxDelay", got)
+	}
+}
+
+func TestClientDo_HonorsRetryAfter(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	cfg := fastRetry(2)
+	cfg.MaxDelay = 5 * time.Millisecond
+	c := NewClient(WithHTTPClient(srv.Client()), WithRetryConfig(cfg))
+
+	start := time.Now()
+	_, err := c.do(context.Background(), apiCall{endpoint: EndpointWebstream, method: "POST", url: srv.URL})
+	if err == nil {
+		t.Fatal("do() should fail once retries are exhausted")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Retry-After should be capped by MaxDelay")
+	}
+	if hits.Load() != 3 {
+		t.Errorf("server hits = %d, want 3", hits.Load())
+	}
+	if !strings.Contains(err.Error(), "retry after 1h0m0s") {
+		t.Errorf("error %q should mention the server-requested delay", err)
+	}
+}
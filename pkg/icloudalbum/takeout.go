@@ -0,0 +1,88 @@
+// ABOUTME: Writes Google Takeout-style JSON sidecars (<file>.json) for photo-manager import
+// ABOUTME: Maps caption, capture and upload times, location and PhotoGUID into Takeout fields
+package icloudalbum
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// TakeoutSidecar is a PostProcessor that writes "<file>.json" in the format of
+// Google Takeout's per-photo metadata, which Immich and PhotoPrism import.
+type TakeoutSidecar struct{}
+
+// Process writes the sidecar for saved.
+func (TakeoutSidecar) Process(_ context.Context, saved SavedPhoto) error {
+	b, err := BuildTakeoutJSON(saved)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(saved.Path+".json", b, 0o644)
+}
+
+// NeedsBackfill reports whether the sidecar for saved is missing.
+func (TakeoutSidecar) NeedsBackfill(saved SavedPhoto) bool {
+	return !fileExists(saved.Path + ".json")
+}
+
+// takeoutJSON mirrors the Takeout fields photo managers read. PhotoGUID is an
+// extra field recording the iCloud identity of the photo.
+type takeoutJSON struct {
+	Title          string       `json:"title"`
+	Description    string       `json:"description"`
+	CreationTime   *takeoutTime `json:"creationTime,omitempty"`
+	PhotoTakenTime *takeoutTime `json:"photoTakenTime,omitempty"`
+	GeoData        takeoutGeo   `json:"geoData"`
+	PhotoGUID      string       `json:"photoGuid"`
+}
+
+type takeoutTime struct {
+	Timestamp string `json:"timestamp"` // Unix seconds
+	Formatted string `json:"formatted"`
+}
+
+// takeoutGeo is all zeros when the location is unknown, as in Takeout itself.
+type takeoutGeo struct {
+	Latitude      float64 `json:"latitude"`
+	Longitude     float64 `json:"longitude"`
+	Altitude      float64 `json:"altitude"`
+	LatitudeSpan  float64 `json:"latitudeSpan"`
+	LongitudeSpan float64 `json:"longitudeSpan"`
+}
+
+// BuildTakeoutJSON renders the Takeout sidecar for a saved photo. photoTakenTime
+// comes from DateCreated (falling back to BatchDateCreated) and creationTime,
+// the upload time, from BatchDateCreated.
+func BuildTakeoutJSON(saved SavedPhoto) ([]byte, error) {
+	photo := saved.Photo
+	out := takeoutJSON{
+		Title:       filepath.Base(saved.Path),
+		Description: derefOr(photo.Caption, ""),
+		PhotoGUID:   photo.PhotoGUID,
+	}
+	if t, _ := captureTime(photo); !t.IsZero() {
+		out.PhotoTakenTime = newTakeoutTime(t)
+	}
+	if t, err := parseAppleDate(derefOr(photo.BatchDateCreated, "")); err == nil {
+		out.CreationTime = newTakeoutTime(t)
+	}
+	if loc := saved.Location; loc != nil {
+		out.GeoData.Latitude, out.GeoData.Longitude = loc.Latitude, loc.Longitude
+		if loc.Altitude != nil {
+			out.GeoData.Altitude = *loc.Altitude
+		}
+	}
+	return json.MarshalIndent(out, "", "  ")
+}
+
+func newTakeoutTime(t time.Time) *takeoutTime {
+	t = t.UTC()
+	return &takeoutTime{
+		Timestamp: strconv.FormatInt(t.Unix(), 10),
+		Formatted: t.Format("Jan 2, 2006, 3:04:05 PM MST"),
+	}
+}
@@ -0,0 +1,89 @@
+// ABOUTME: Test suite for Google Takeout-style JSON sidecars
+// ABOUTME: Checks field mapping from Image, Metadata and Location and the sidecar file name
+package icloudalbum
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildTakeoutJSON(t *testing.T) {
+	alt := 5.0
+	tests := []struct {
+		name  string
+		saved SavedPhoto
+		check func(t *testing.T, got map[string]any)
+	}{
+		{
+			name: "all fields",
+			saved: SavedPhoto{
+				Path: "/out/2020/beach.jpg",
+				Photo: &Image{
+					PhotoGUID:        "g1",
+					Caption:          strPtr("Beach day"),
+					DateCreated:      strPtr("2020-09-13T12:26:40Z"),
+					BatchDateCreated: strPtr("2020-09-14T08:00:00Z"),
+				},
+				Location: &Location{Latitude: 1.5, Longitude: -2.5, Altitude: &alt},
+			},
+			check: func(t *testing.T, got map[string]any) {
+				if got["title"] != "beach.jpg" || got["description"] != "Beach day" || got["photoGuid"] != "g1" {
+					t.Errorf("title/description/photoGuid = %v/%v/%v", got["title"], got["description"], got["photoGuid"])
+				}
+				taken := got["photoTakenTime"].(map[string]any)
+				if taken["timestamp"] != "1600000000" || taken["formatted"] != "Sep 13, 2020, 12:26:40 PM UTC" {
+					t.Errorf("photoTakenTime = %v", taken)
+				}
+				if created := got["creationTime"].(map[string]any); created["timestamp"] != "1600070400" {
+					t.Errorf("creationTime = %v", created)
+				}
+				geo := got["geoData"].(map[string]any)
+				if geo["latitude"] != 1.5 || geo["longitude"] != -2.5 || geo["altitude"] != 5.0 {
+					t.Errorf("geoData = %v", geo)
+				}
+			},
+		},
+		{
+			name:  "bare photo",
+			saved: SavedPhoto{Path: "/out/x.png", Photo: &Image{PhotoGUID: "g2"}},
+			check: func(t *testing.T, got map[string]any) {
+				if _, ok := got["photoTakenTime"]; ok {
+					t.Error("photoTakenTime should be omitted without dates")
+				}
+				if geo := got["geoData"].(map[string]any); geo["latitude"] != 0.0 || geo["longitude"] != 0.0 {
+					t.Errorf("geoData = %v, want zeros", geo)
+				}
+				if got["description"] != "" {
+					t.Errorf("description = %v, want empty", got["description"])
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := BuildTakeoutJSON(tt.saved)
+			if err != nil {
+				t.Fatalf("BuildTakeoutJSON() error = %v", err)
+			}
+			var got map[string]any
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatalf("sidecar is not JSON: %v", err)
+			}
+			tt.check(t, got)
+		})
+	}
+}
+
+func TestTakeoutSidecar_Process(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "p.jpg")
+	err := TakeoutSidecar{}.Process(context.Background(), SavedPhoto{Path: path, Photo: &Image{PhotoGUID: "g"}})
+	if err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+	if _, err := os.Stat(path + ".json"); err != nil {
+		t.Errorf("sidecar p.jpg.json not written: %v", err)
+	}
+}
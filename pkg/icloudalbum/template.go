@@ -0,0 +1,239 @@
+// ABOUTME: Path templates for naming downloaded files, e.g. "{year}/{month}/{date}_{caption|guid}{ext}"
+// ABOUTME: Expands photo fields, sanitizes every value and keeps results inside the output directory
+package icloudalbum
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidTemplate is returned by ParsePathTemplate for malformed templates.
+var ErrInvalidTemplate = errors.New("icloudalbum: invalid path template")
+
+// PathTemplate names downloaded files. Placeholders are written {field},
+// {field|fallback|...} (first non-empty value wins) or {field:spec}. Fields:
+//
+//	guid, caption, contributor, key (derivative key), ext (".jpg", sniffed)
+//	index, width, height       numbers; spec is a zero-pad width, e.g. {index:04}
+//	date, batch                DateCreated / BatchDateCreated; spec is a Go time
+//	                           layout (default 2006-01-02), e.g. {date:2006-01}
+//	year, month, day           parts of DateCreated
+//
+// index is 1-based; width and height come from the selected derivative, falling
+// back to the photo. "/" separates directories. Values are passed through
+// sanitize, so they can never introduce separators or escape the output
+// directory.
+type PathTemplate struct {
+	raw   string
+	parts []templatePart
+}
+
+// templatePart is either literal text or a placeholder with alternatives.
+type templatePart struct {
+	literal string
+	fields  []string
+	spec    string
+}
+
+// PathFields are the values a PathTemplate is expanded with.
+type PathFields struct {
+	Photo         *Image
+	Index         int // 0-based position in the album
+	DerivativeKey string
+	Derivative    Derivative
+	Ext           string
+}
+
+var templateFields = map[string]bool{
+	"guid": true, "caption": true, "contributor": true, "key": true, "ext": true,
+	"index": true, "width": true, "height": true,
+	"date": true, "batch": true, "year": true, "month": true, "day": true,
+}
+
+// ParsePathTemplate parses and validates a path template.
+func ParsePathTemplate(s string) (*PathTemplate, error) {
+	t := &PathTemplate{raw: s}
+	if strings.TrimSpace(s) == "" {
+		return nil, fmt.Errorf("%w: empty template", ErrInvalidTemplate)
+	}
+	if strings.HasPrefix(s, "/") || filepath.IsAbs(s) {
+		return nil, fmt.Errorf("%w: %q must be relative", ErrInvalidTemplate, s)
+	}
+	rest := s
+	for rest != "" {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			t.parts = append(t.parts, templatePart{literal: rest})
+			break
+		}
+		if open > 0 {
+			t.parts = append(t.parts, templatePart{literal: rest[:open]})
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("%w: unterminated placeholder in %q", ErrInvalidTemplate, s)
+		}
+		body := rest[open+1 : open+end]
+		names, spec, _ := strings.Cut(body, ":")
+		p := templatePart{spec: spec}
+		for _, name := range strings.Split(names, "|") {
+			if !templateFields[name] {
+				return nil, fmt.Errorf("%w: unknown field %q", ErrInvalidTemplate, name)
+			}
+			p.fields = append(p.fields, name)
+		}
+		if spec != "" && !numericField(p.fields[0]) && !dateField(p.fields[0]) {
+			return nil, fmt.Errorf("%w: field %q takes no format", ErrInvalidTemplate, p.fields[0])
+		}
+		t.parts = append(t.parts, p)
+		rest = rest[open+end+1:]
+	}
+	for _, p := range t.parts {
+		if strings.ContainsAny(p.literal, "{}\\") {
+			return nil, fmt.Errorf("%w: stray brace or backslash in %q", ErrInvalidTemplate, s)
+		}
+		for _, seg := range strings.Split(p.literal, "/") {
+			if seg == ".." {
+				return nil, fmt.Errorf("%w: %q may not contain ..", ErrInvalidTemplate, s)
+			}
+		}
+	}
+	return t, nil
+}
+
+// MustParsePathTemplate is like ParsePathTemplate but panics on error.
+func MustParsePathTemplate(s string) *PathTemplate {
+	t, err := ParsePathTemplate(s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// String returns the template source.
+func (t *PathTemplate) String() string { return t.raw }
+
+// Expand returns the slash-separated relative path for f. It fails if the
+// result would not be a local path.
+func (t *PathTemplate) Expand(f PathFields) (string, error) {
+	var b strings.Builder
+	for _, p := range t.parts {
+		if p.fields == nil {
+			b.WriteString(p.literal)
+			continue
+		}
+		for _, name := range p.fields {
+			if v := f.value(name, p.spec); v != "" {
+				b.WriteString(v)
+				break
+			}
+		}
+	}
+
+	segs := strings.Split(b.String(), "/")
+	out := segs[:0]
+	for _, seg := range segs {
+		switch seg {
+		case "", ".":
+			continue
+		case "..":
+			return "", fmt.Errorf("%w: %q expands outside the output directory", ErrInvalidTemplate, t.raw)
+		}
+		out = append(out, seg)
+	}
+	rel := path.Join(out...)
+	if rel == "" || !filepath.IsLocal(filepath.FromSlash(rel)) {
+		return "", fmt.Errorf("%w: %q expands to unusable path %q", ErrInvalidTemplate, t.raw, rel)
+	}
+	return rel, nil
+}
+
+// value returns the sanitized value of one field ("" when unknown or empty).
+func (f PathFields) value(name, spec string) string {
+	p := f.Photo
+	switch name {
+	case "guid":
+		return sanitize(p.PhotoGUID)
+	case "caption":
+		return sanitize(derefOr(p.Caption, ""))
+	case "contributor":
+		return sanitize(p.Contributor())
+	case "key":
+		return sanitize(f.DerivativeKey)
+	case "ext":
+		return f.Ext
+	case "index":
+		return padNumber(uint64(f.Index+1), spec)
+	case "width", "height":
+		dim, fallback := f.Derivative.Width, p.Width
+		if name == "height" {
+			dim, fallback = f.Derivative.Height, p.Height
+		}
+		if dim == nil {
+			dim = fallback
+		}
+		if dim == nil {
+			return ""
+		}
+		return padNumber(uint64(*dim), spec)
+	case "date", "batch", "year", "month", "day":
+		src := p.DateCreated
+		if name == "batch" {
+			src = p.BatchDateCreated
+		}
+		tm, err := parseAppleDate(derefOr(src, ""))
+		if err != nil {
+			return ""
+		}
+		layout := map[string]string{"year": "2006", "month": "01", "day": "02"}[name]
+		if layout == "" {
+			layout = spec
+		}
+		if layout == "" {
+			layout = "2006-01-02"
+		}
+		return sanitize(tm.Format(layout))
+	}
+	return ""
+}
+
+func numericField(name string) bool {
+	return name == "index" || name == "width" || name == "height"
+}
+
+func dateField(name string) bool {
+	return name == "date" || name == "batch"
+}
+
+// padNumber formats n, zero-padded to the width given by spec ("04" or "4").
+func padNumber(n uint64, spec string) string {
+	width, err := strconv.Atoi(spec)
+	if err != nil || width <= 0 {
+		return strconv.FormatUint(n, 10)
+	}
+	return fmt.Sprintf("%0*d", width, n)
+}
+
+// appleDateLayouts are the timestamp forms seen in DateCreated and BatchDateCreated.
+var appleDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// parseAppleDate parses a webstream timestamp.
+func parseAppleDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range appleDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized date %q", s)
+}
@@ -0,0 +1,140 @@
+// ABOUTME: Test suite for download path templates
+// ABOUTME: Covers parsing, field expansion, sanitization and output-directory containment
+package icloudalbum
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParsePathTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		tmpl    string
+		wantErr bool
+	}{
+		{"simple", "{guid}{ext}", false},
+		{"directories and alternatives", "{year}/{month}/{date}_{caption|guid}{ext}", false},
+		{"padded index", "{batch}/{index:04}{ext}", false},
+		{"date layout", "{date:2006-01}/{guid}{ext}", false},
+		{"empty", "", true},
+		{"absolute", "/tmp/{guid}", true},
+		{"parent directory", "../{guid}", true},
+		{"unknown field", "{nope}", true},
+		{"unterminated", "{guid", true},
+		{"stray brace", "guid}", true},
+		{"format on string field", "{caption:04}", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParsePathTemplate(tt.tmpl)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePathTemplate(%q) error = %v, wantErr %v", tt.tmpl, err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidTemplate) {
+				t.Errorf("error %v should wrap ErrInvalidTemplate", err)
+			}
+		})
+	}
+}
+
+func TestPathTemplate_Expand(t *testing.T) {
+	w, h := Uint32OrString(4032), Uint32OrString(3024)
+	photo := &Image{
+		PhotoGUID:           "ABC-123",
+		Caption:             strPtr("Beach / Day: 1"),
+		DateCreated:         strPtr("2023-07-04T18:30:00Z"),
+		BatchDateCreated:    strPtr("2023-07-05T09:00:00Z"),
+		ContributorFullName: strPtr("Ada Lovelace"),
+	}
+	full := PathFields{Photo: photo, Index: 6, DerivativeKey: "original", Derivative: Derivative{Width: &w, Height: &h}, Ext: ".jpg"}
+	bare := PathFields{Photo: &Image{PhotoGUID: "XYZ"}, Index: 0, Ext: ".png"}
+
+	tests := []struct {
+		name   string
+		tmpl   string
+		fields PathFields
+		want   string
+	}{
+		{"date directories", "{year}/{month}/{date}_{caption|guid}{ext}", full, "2023/07/2023-07-04_Beach _ Day_ 1.jpg"},
+		{"batch and padded index", "{batch}/{index:04}{ext}", full, "2023-07-05/0007.jpg"},
+		{"date layout", "{date:2006-01-02_150405}{ext}", full, "2023-07-04_183000.jpg"},
+		{"contributor key and size", "{contributor}/{key}_{width}x{height}{ext}", full, "Ada Lovelace/original_4032x3024.jpg"},
+		{"fallback to guid", "{caption|guid}{ext}", bare, "XYZ.png"},
+		{"empty directory collapses", "{year}/{guid}{ext}", bare, "XYZ.png"},
+		{"ext may be empty", "{guid}{ext}", PathFields{Photo: photo}, "ABC-123"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MustParsePathTemplate(tt.tmpl).Expand(tt.fields)
+			if err != nil || got != tt.want {
+				t.Errorf("Expand(%q) = %q, %v; want %q", tt.tmpl, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPathTemplate_ExpandStaysLocal(t *testing.T) {
+	photo := &Image{PhotoGUID: "..", Caption: strPtr("../../etc/passwd")}
+	for _, tmpl := range []string{"{caption}{ext}", "{guid}", "{caption}/{guid}"} {
+		got, err := MustParsePathTemplate(tmpl).Expand(PathFields{Photo: photo})
+		if err == nil && !filepath.IsLocal(filepath.FromSlash(got)) {
+			t.Errorf("Expand(%q) = %q escapes the output directory", tmpl, got)
+		}
+	}
+}
+
+func TestParseAppleDate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"2023-07-04T18:30:00Z", "2023-07-04T18:30:00Z", false},
+		{"2023-07-04T18:30:00.123-07:00", "2023-07-05T01:30:00Z", false},
+		{"2023-07-04 18:30:00", "2023-07-04T18:30:00Z", false},
+		{"2023-07-04", "2023-07-04T00:00:00Z", false},
+		{"", "", true},
+		{"yesterday", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseAppleDate(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAppleDate(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if !tt.wantErr && got.UTC().Format("2006-01-02T15:04:05Z07:00") != tt.want {
+				t.Errorf("parseAppleDate(%q) = %v, want %s", tt.in, got.UTC(), tt.want)
+			}
+		})
+	}
+}
+
+func TestClient_DownloadTo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A})
+	}))
+	defer srv.Close()
+
+	photo := photoAt("g1", srv.URL+"/a")
+	photo.DateCreated = strPtr("2021-12-25T08:00:00Z")
+	dir := t.TempDir()
+	c := NewClient(WithDownloadHTTPClient(srv.Client()))
+	fp, err := c.DownloadTo(context.Background(), photo, 2, dir, MustParsePathTemplate("{year}/{month}/{index:03}_{guid}{ext}"))
+	if err != nil {
+		t.Fatalf("DownloadTo() error = %v", err)
+	}
+	if want := filepath.Join(dir, "2021", "12", "003_g1.png"); fp != want {
+		t.Errorf("DownloadTo() path = %q, want %q", fp, want)
+	}
+	if _, err := os.Stat(fp); err != nil {
+		t.Errorf("downloaded file missing: %v", err)
+	}
+}
+
+func strPtr(s string) *string { return &s }
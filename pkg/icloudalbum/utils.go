@@ -3,7 +3,6 @@
 package icloudalbum
 
 import (
-	"log"
 	"mime"
 	"net/http"
 	"path/filepath"
@@ -28,7 +27,7 @@ func ExtensionFromMIME(mt string) string {
 	case "image/gif":
 		return ".gif"
 	default:
-		log.Printf("warn: unknown MIME type %q; defaulting to .jpg", mt)
+		defaultLogger().Warn("unknown MIME type; defaulting to .jpg", "mime", mt)
 		return ".jpg"
 	}
 }
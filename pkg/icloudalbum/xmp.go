@@ -0,0 +1,109 @@
+// ABOUTME: Writes XMP sidecars with caption, capture dates, contributor, album name and GPS
+// ABOUTME: Output follows the XMP packet format read by Lightroom, digiKam and darktable
+package icloudalbum
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// XMPSidecar is a PostProcessor that writes an .xmp sidecar next to each
+// download. By default the sidecar is named "<file>.xmp" (digiKam and
+// darktable); with ReplaceExtension it is "<name>.xmp" (Lightroom).
+type XMPSidecar struct {
+	ReplaceExtension bool
+}
+
+// Process writes the sidecar for saved.
+func (x XMPSidecar) Process(_ context.Context, saved SavedPhoto) error {
+	return os.WriteFile(x.path(saved), BuildXMP(saved), 0o644)
+}
+
+// NeedsBackfill reports whether the sidecar for saved is missing.
+func (x XMPSidecar) NeedsBackfill(saved SavedPhoto) bool {
+	return !fileExists(x.path(saved))
+}
+
+func (x XMPSidecar) path(saved SavedPhoto) string {
+	if x.ReplaceExtension {
+		return strings.TrimSuffix(saved.Path, filepath.Ext(saved.Path)) + ".xmp"
+	}
+	return saved.Path + ".xmp"
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// BuildXMP renders the XMP packet for a saved photo. Empty fields are omitted.
+func BuildXMP(saved SavedPhoto) []byte {
+	var b strings.Builder
+	b.WriteString("<?xpacket begin=\"\uFEFF\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	b.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	b.WriteString("  <rdf:Description rdf:about=\"\"\n")
+	b.WriteString("    xmlns:dc=\"http://purl.org/dc/elements/1.1/\"\n")
+	b.WriteString("    xmlns:xmp=\"http://ns.adobe.com/xap/1.0/\"\n")
+	b.WriteString("    xmlns:photoshop=\"http://ns.adobe.com/photoshop/1.0/\"\n")
+	b.WriteString("    xmlns:xmpDM=\"http://ns.adobe.com/xmp/1.0/DynamicMedia/\"\n")
+	b.WriteString("    xmlns:exif=\"http://ns.adobe.com/exif/1.0/\">\n")
+
+	photo := saved.Photo
+	if caption := derefOr(photo.Caption, ""); caption != "" {
+		fmt.Fprintf(&b, "   <dc:description>\n    <rdf:Alt>\n     <rdf:li xml:lang=\"x-default\">%s</rdf:li>\n    </rdf:Alt>\n   </dc:description>\n", xmlText(caption))
+	}
+	if who := photo.Contributor(); who != "" {
+		fmt.Fprintf(&b, "   <dc:creator>\n    <rdf:Seq>\n     <rdf:li>%s</rdf:li>\n    </rdf:Seq>\n   </dc:creator>\n", xmlText(who))
+	}
+	if saved.Album != nil && saved.Album.StreamName != "" {
+		album := xmlText(saved.Album.StreamName)
+		fmt.Fprintf(&b, "   <dc:subject>\n    <rdf:Bag>\n     <rdf:li>%s</rdf:li>\n    </rdf:Bag>\n   </dc:subject>\n", album)
+		fmt.Fprintf(&b, "   <xmpDM:album>%s</xmpDM:album>\n", album)
+	}
+	if t, _ := captureTime(photo); !t.IsZero() {
+		ts := t.Format(time.RFC3339)
+		fmt.Fprintf(&b, "   <xmp:CreateDate>%s</xmp:CreateDate>\n", ts)
+		fmt.Fprintf(&b, "   <photoshop:DateCreated>%s</photoshop:DateCreated>\n", ts)
+	}
+	if loc := saved.Location; loc != nil {
+		b.WriteString("   <exif:GPSVersionID>2.3.0.0</exif:GPSVersionID>\n")
+		fmt.Fprintf(&b, "   <exif:GPSLatitude>%s</exif:GPSLatitude>\n", xmpCoordinate(loc.Latitude, 'N', 'S'))
+		fmt.Fprintf(&b, "   <exif:GPSLongitude>%s</exif:GPSLongitude>\n", xmpCoordinate(loc.Longitude, 'E', 'W'))
+		if alt := loc.Altitude; alt != nil {
+			ref := 0
+			if *alt < 0 {
+				ref = 1
+			}
+			fmt.Fprintf(&b, "   <exif:GPSAltitudeRef>%d</exif:GPSAltitudeRef>\n", ref)
+			fmt.Fprintf(&b, "   <exif:GPSAltitude>%d/100</exif:GPSAltitude>\n", int64(math.Round(math.Abs(*alt)*100)))
+		}
+	}
+
+	b.WriteString("  </rdf:Description>\n </rdf:RDF>\n</x:xmpmeta>\n")
+	b.WriteString("<?xpacket end=\"w\"?>\n")
+	return []byte(b.String())
+}
+
+// xmpCoordinate formats a coordinate the way the XMP EXIF schema expects:
+// degrees, decimal minutes and a hemisphere letter, e.g. "37,46.494000N".
+func xmpCoordinate(v float64, pos, neg byte) string {
+	ref := pos
+	if v < 0 {
+		ref, v = neg, -v
+	}
+	deg := math.Floor(v)
+	return fmt.Sprintf("%d,%.6f%c", int(deg), (v-deg)*60, ref)
+}
+
+func xmlText(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
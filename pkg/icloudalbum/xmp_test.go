@@ -0,0 +1,228 @@
+// ABOUTME: Test suite for XMP sidecar generation
+// ABOUTME: Checks packet contents, XML well-formedness, GPS formatting and sidecar naming
+package icloudalbum
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestXMPCoordinate(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want string
+	}{
+		{37.7749, "37,46.494000N"},
+		{-122.4194, "122,25.164000W"},
+		{0, "0,0.000000N"},
+	}
+	for _, tt := range tests {
+		pos, neg := byte('N'), byte('S')
+		if strings.HasSuffix(tt.want, "W") {
+			pos, neg = 'E', 'W'
+		}
+		if got := xmpCoordinate(tt.v, pos, neg); got != tt.want {
+			t.Errorf("xmpCoordinate(%v) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestBuildXMP(t *testing.T) {
+	alt := 12.3
+	saved := SavedPhoto{
+		Path: "/out/p.jpg",
+		Photo: &Image{
+			PhotoGUID:           "g1",
+			Caption:             strPtr(`Fish & "chips" <3`),
+			DateCreated:         strPtr("2022-08-09T10:11:12Z"),
+			ContributorFullName: strPtr("Ada Lovelace"),
+		},
+		Album:    &Metadata{StreamName: "Summer"},
+		Location: &Location{Latitude: 37.7749, Longitude: -122.4194, Altitude: &alt},
+	}
+	out := BuildXMP(saved)
+
+	dec := xml.NewDecoder(bytes.NewReader(out))
+	for {
+		if _, err := dec.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("XMP is not well-formed: %v\n%s", err, out)
+		}
+	}
+
+	for _, want := range []string{
+		`<rdf:li xml:lang="x-default">Fish &amp; &#34;chips&#34; &lt;3</rdf:li>`,
+		`<rdf:li>Ada Lovelace</rdf:li>`,
+		`<xmpDM:album>Summer</xmpDM:album>`,
+		`<xmp:CreateDate>2022-08-09T10:11:12Z</xmp:CreateDate>`,
+		`<photoshop:DateCreated>2022-08-09T10:11:12Z</photoshop:DateCreated>`,
+		`<exif:GPSLatitude>37,46.494000N</exif:GPSLatitude>`,
+		`<exif:GPSLongitude>122,25.164000W</exif:GPSLongitude>`,
+		`<exif:GPSAltitude>1230/100</exif:GPSAltitude>`,
+	} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Errorf("XMP missing %s", want)
+		}
+	}
+
+	bare := BuildXMP(SavedPhoto{Photo: &Image{PhotoGUID: "g2"}})
+	for _, absent := range []string{"dc:description", "dc:creator", "xmp:CreateDate", "exif:GPSLatitude"} {
+		if bytes.Contains(bare, []byte(absent)) {
+			t.Errorf("XMP for a bare photo should omit %s", absent)
+		}
+	}
+}
+
+type failingProcessor struct{}
+
+func (failingProcessor) Process(context.Context, SavedPhoto) error { return errors.New("disk full") }
+
+func TestClient_DownloadAlbum_XMPSidecar(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte{0xFF, 0xD8, 0xFF})
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		sidecar XMPSidecar
+		file    string
+	}{
+		{"appended extension", XMPSidecar{}, "1_g0_Sunset.jpg.xmp"},
+		{"replaced extension", XMPSidecar{ReplaceExtension: true}, "1_g0_Sunset.xmp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := albumOf(srv, 1)
+			resp.Metadata = Metadata{StreamName: "Trip", Locations: []byte(`{"g0":{"latitude":1,"longitude":2}}`)}
+			resp.Photos[0].Caption = strPtr("Sunset")
+			dir := t.TempDir()
+
+			c := NewClient(WithDownloadHTTPClient(srv.Client()))
+			report, err := c.DownloadAlbum(context.Background(), resp, DownloadOptions{
+				OutputDir:      dir,
+				PostProcessors: []PostProcessor{tt.sidecar, failingProcessor{}},
+			})
+			if err != nil || report.Downloaded != 1 {
+				t.Fatalf("DownloadAlbum() = %+v, %v", report, err)
+			}
+			if report.Results[0].PostErr == nil {
+				t.Error("PostErr should report the failing post-processor")
+			}
+			b, err := os.ReadFile(filepath.Join(dir, tt.file))
+			if err != nil {
+				t.Fatalf("sidecar not written: %v", err)
+			}
+			for _, want := range []string{"Sunset", "Trip", "exif:GPSLatitude"} {
+				if !bytes.Contains(b, []byte(want)) {
+					t.Errorf("sidecar missing %q", want)
+				}
+			}
+		})
+	}
+}
+
+func TestClient_DownloadAlbum_BackfillsSidecars(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, _ = w.Write([]byte{0xFF, 0xD8, 0xFF})
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	resp := albumOf(srv, 2)
+	c := NewClient(WithDownloadHTTPClient(srv.Client()))
+	run := func(post ...PostProcessor) *DownloadReport {
+		t.Helper()
+		report, err := c.DownloadAlbum(context.Background(), resp, DownloadOptions{
+			OutputDir: dir, UseManifest: true, PostProcessors: post,
+		})
+		if err != nil {
+			t.Fatalf("DownloadAlbum() error = %v", err)
+		}
+		return report
+	}
+	sidecars := []string{"1_g0.jpg.xmp", "2_g1.jpg.xmp", "1_g0.jpg.json", "2_g1.jpg.json"}
+
+	// Synced earlier without sidecars; asking for them now writes them.
+	run()
+	hits.Store(0)
+	report := run(XMPSidecar{}, TakeoutSidecar{})
+	if report.Unchanged != 2 || hits.Load() != 0 {
+		t.Fatalf("report = %+v, %d requests; want 2 unchanged and no downloads", report, hits.Load())
+	}
+	for _, f := range sidecars {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Errorf("sidecar %s not backfilled: %v", f, err)
+		}
+	}
+
+	// Existing sidecars are left alone; a deleted one is written again.
+	if err := os.WriteFile(filepath.Join(dir, "1_g0.jpg.xmp"), []byte("edited"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "2_g1.jpg.json")); err != nil {
+		t.Fatal(err)
+	}
+	report = run(XMPSidecar{}, TakeoutSidecar{})
+	if report.Unchanged != 2 {
+		t.Fatalf("report = %+v; want 2 unchanged", report)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "1_g0.jpg.xmp")); string(b) != "edited" {
+		t.Error("existing sidecar was rewritten")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "2_g1.jpg.json")); err != nil {
+		t.Errorf("deleted sidecar not backfilled: %v", err)
+	}
+}
+
+func TestClient_DownloadAlbum_AlbumLocationIsNotGPS(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte{0xFF, 0xD8, 0xFF})
+	}))
+	defer srv.Close()
+
+	resp := albumOf(srv, 1)
+	resp.Metadata.Locations = []byte(`{"latitude":10,"longitude":20}`)
+	dir := t.TempDir()
+	var got SavedPhoto
+	c := NewClient(WithDownloadHTTPClient(srv.Client()))
+	_, err := c.DownloadAlbum(context.Background(), resp, DownloadOptions{
+		OutputDir: dir,
+		PostProcessors: []PostProcessor{XMPSidecar{}, TakeoutSidecar{}, processorFunc(func(s SavedPhoto) error {
+			got = s
+			return nil
+		})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Location != nil || got.AlbumLocation == nil || got.AlbumLocation.Latitude != 10 {
+		t.Errorf("SavedPhoto Location = %v, AlbumLocation = %v; want only the album location", got.Location, got.AlbumLocation)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "1_g0.jpg.xmp")); bytes.Contains(b, []byte("GPS")) {
+		t.Error("XMP sidecar has GPS from the album-wide location")
+	}
+	var takeout takeoutJSON
+	b, _ := os.ReadFile(filepath.Join(dir, "1_g0.jpg.json"))
+	if err := json.Unmarshal(b, &takeout); err != nil || takeout.GeoData.Latitude != 0 || takeout.GeoData.Longitude != 0 {
+		t.Errorf("Takeout geoData = %+v, %v; want zeros", takeout.GeoData, err)
+	}
+}
+
+type processorFunc func(SavedPhoto) error
+
+func (f processorFunc) Process(_ context.Context, s SavedPhoto) error { return f(s) }